@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Used when the anonymous tier is enabled without its own limits
+const defaultAnonymousMaxLimit = 25
+
+var defaultAnonymousRateLimit = RateLimit{Rate: 1, Burst: 10}
+
+// Read only scopes available to requests without a key when the anonymous tier is enabled
+var anonymousScopes = []string{ScopeGamesRead, ScopeTagsRead, ScopeCategoriesRead}
+
+type AnonymousConfig struct {
+	Enabled bool `json:"Enabled"`
+	// Applied per client address
+	RateLimit *RateLimit `json:"RateLimit"`
+	// Largest page size allowed in a game search
+	MaxLimit int `json:"MaxLimit"`
+	// Take the client address from the last X-Forwarded-For entry, only safe behind a proxy which appends it
+	TrustForwardedFor bool `json:"TrustForwardedFor"`
+}
+
+func (c AnonymousConfig) rateLimit() *RateLimit {
+	if c.RateLimit != nil {
+		return c.RateLimit
+	}
+	return &defaultAnonymousRateLimit
+}
+
+func (c AnonymousConfig) maxLimit() int {
+	if c.MaxLimit > 0 {
+		return c.MaxLimit
+	}
+	return defaultAnonymousMaxLimit
+}
+
+func (k *ApiKeyRecord) isAnonymous() bool {
+	return k.Level == "anonymous"
+}
+
+func clientAddress(r *http.Request, trustForwardedFor bool) string {
+	// Proxies append to whatever the client sent, so only the last address is the trusted proxy's own
+	if trustForwardedFor {
+		headers := r.Header.Values("X-Forwarded-For")
+		if len(headers) > 0 {
+			addresses := strings.Split(headers[len(headers)-1], ",")
+			if last := strings.TrimSpace(addresses[len(addresses)-1]); last != "" {
+				return last
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Admits a request without a key to read only routes, under the anonymous rate limit of its address
+func checkAnonymousAuth(w http.ResponseWriter, r *http.Request, scope string) (*ApiKeyRecord, bool) {
+	anonymous := currentConfig().Anonymous
+	if !anonymous.Enabled {
+		return nil, false
+	}
+	record := &ApiKeyRecord{
+		Id:      "anonymous:" + clientAddress(r, anonymous.TrustForwardedFor),
+		Label:   "anonymous",
+		Level:   "anonymous",
+		Scopes:  anonymousScopes,
+		SfwOnly: true,
+	}
+	if !record.hasScope(scope) {
+		return nil, false
+	}
+	if !enforceRateLimit(w, record.Id, anonymous.rateLimit()) {
+		return nil, true
+	}
+	return record, true
+}
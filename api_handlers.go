@@ -1,11 +1,13 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -87,13 +89,21 @@ func apiTagNewPost(w http.ResponseWriter, r *http.Request) {
 	}
 	_, findErr := _getTagAlias(*apiRequest.PrimaryAlias)
 	if findErr != nil {
-		sqlErr := createTag(apiRequest)
+		sqlErr := createTag(apiRequest, func(tx *sql.Tx, tagId int) *DbResultError {
+			return auditTagWrite(tx, r, tagId, nil)
+		})
 		if sqlErr != nil {
 			printError(sqlErr)
 			sendApiResult(w, sqlErr.status, sqlErr.message, nil)
 			return
 		} else {
-			res, sqlErr := getTagByName(*apiRequest.PrimaryAlias)
+			alias, sqlErr := _getTagAlias(*apiRequest.PrimaryAlias)
+			if sqlErr != nil {
+				printError(sqlErr)
+				sendApiResult(w, sqlErr.status, sqlErr.message, nil)
+				return
+			}
+			res, sqlErr := getTagById(alias.tagId)
 			if sqlErr != nil {
 				printError(sqlErr)
 				sendApiResult(w, sqlErr.status, sqlErr.message, nil)
@@ -123,7 +133,15 @@ func apiTagPost(w http.ResponseWriter, r *http.Request) {
 		sendApiResult(w, findErr.status, findErr.message, nil)
 		return
 	} else {
-		sqlErr := updateTag(alias.tagId, apiRequest, nil)
+		before, sqlErr := getTagById(alias.tagId)
+		if sqlErr != nil {
+			printError(sqlErr)
+			sendApiResult(w, sqlErr.status, sqlErr.message, nil)
+			return
+		}
+		sqlErr = updateTag(alias.tagId, apiRequest, nil, func(tx *sql.Tx, tagId int) *DbResultError {
+			return auditTagWrite(tx, r, tagId, before)
+		})
 		if sqlErr != nil {
 			printError(sqlErr)
 			sendApiResult(w, sqlErr.status, sqlErr.message, nil)
@@ -141,3 +159,56 @@ func apiTagPost(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+func apiAuditGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	auditQuery := AuditQuery{
+		KeyId:  query.Get("key"),
+		Limit:  100,
+		Offset: 0,
+	}
+	if query.Get("tag") != "" {
+		tagId, err := strconv.Atoi(query.Get("tag"))
+		if err != nil {
+			sendApiResult(w, 400, "'tag' param must be a tag id", nil)
+			return
+		}
+		auditQuery.TagId = &tagId
+	}
+	for _, param := range []struct {
+		name string
+		dest **time.Time
+	}{{"since", &auditQuery.Since}, {"until", &auditQuery.Until}} {
+		if query.Get(param.name) != "" {
+			t, err := time.Parse(time.RFC3339, query.Get(param.name))
+			if err != nil {
+				sendApiResult(w, 400, fmt.Sprintf("'%s' param must be an RFC3339 time", param.name), nil)
+				return
+			}
+			*param.dest = &t
+		}
+	}
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > 1000 {
+			sendApiResult(w, 400, "'limit' param must be between 1 and 1000", nil)
+			return
+		}
+		auditQuery.Limit = limit
+	}
+	if query.Get("offset") != "" {
+		offset, err := strconv.Atoi(query.Get("offset"))
+		if err != nil || offset < 0 {
+			sendApiResult(w, 400, "'offset' param must be a non-negative integer", nil)
+			return
+		}
+		auditQuery.Offset = offset
+	}
+	entries, err := findAuditEntries(auditQuery)
+	if err != nil {
+		printError(err)
+		sendApiResult(w, err.status, err.message, nil)
+	} else {
+		sendApiResult(w, 200, fmt.Sprintf("Found %d Entries", len(entries)), entries)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func auditInit() error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp TEXT NOT NULL,
+		keyId TEXT NOT NULL,
+		keyLabel TEXT NOT NULL DEFAULT '',
+		method TEXT NOT NULL,
+		route TEXT NOT NULL,
+		tagId INTEGER,
+		before TEXT,
+		after TEXT
+	)`)
+	if err != nil {
+		return err
+	}
+	// Entries can only ever be added
+	for _, action := range []string{"UPDATE", "DELETE"} {
+		_, err = db.Exec(`CREATE TRIGGER IF NOT EXISTS audit_log_no_` + strings.ToLower(action) + ` BEFORE ` + action + ` ON audit_log
+			BEGIN SELECT RAISE(ABORT, 'audit_log is append-only'); END`)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS audit_log_tag ON audit_log (tagId, timestamp)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS audit_log_key ON audit_log (keyId, timestamp)")
+	return err
+}
+
+func marshalNullJson(v *Api_TagModel) sql.NullString {
+	if v == nil {
+		return sql.NullString{}
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(raw), Valid: true}
+}
+
+// Records a tag write made by the key which authorized the request, in the write's own transaction
+// so the write doesn't happen unless its entry is stored
+func auditTagWrite(tx *sql.Tx, r *http.Request, tagId int, before *Api_TagModel) *DbResultError {
+	record := requestApiKey(r)
+	if record == nil {
+		record = &ApiKeyRecord{Id: "unknown"}
+	}
+	after, dbErr := getTagByIdFrom(tx, tagId)
+	if dbErr != nil {
+		return dbErr
+	}
+	_, err := tx.Exec("INSERT INTO audit_log (timestamp, keyId, keyLabel, method, route, tagId, before, after) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		time.Now().UTC().Format(dbTimeLayout),
+		record.Id,
+		record.Label,
+		r.Method,
+		r.URL.Path,
+		tagId,
+		marshalNullJson(before),
+		marshalNullJson(after))
+	if err != nil {
+		return &DbResultError{status: 500, message: "Unable to write audit log", err: err}
+	}
+	return nil
+}
+
+type AuditQuery struct {
+	KeyId  string
+	TagId  *int
+	Since  *time.Time
+	Until  *time.Time
+	Limit  int
+	Offset int
+}
+
+func findAuditEntries(query AuditQuery) ([]Api_AuditEntryModel, *DbResultError) {
+	var conditions []string
+	var args []interface{}
+	if query.KeyId != "" {
+		conditions = append(conditions, "audit_log.keyId = ?")
+		args = append(args, query.KeyId)
+	}
+	if query.TagId != nil {
+		conditions = append(conditions, "audit_log.tagId = ?")
+		args = append(args, *query.TagId)
+	}
+	if query.Since != nil {
+		conditions = append(conditions, "audit_log.timestamp >= ?")
+		args = append(args, query.Since.UTC().Format(dbTimeLayout))
+	}
+	if query.Until != nil {
+		conditions = append(conditions, "audit_log.timestamp < ?")
+		args = append(args, query.Until.UTC().Format(dbTimeLayout))
+	}
+	sqlQuery := "SELECT id, timestamp, keyId, keyLabel, method, route, tagId, before, after FROM audit_log"
+	if len(conditions) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sqlQuery += " ORDER BY audit_log.id DESC LIMIT ? OFFSET ?"
+	args = append(args, query.Limit, query.Offset)
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, &DbResultError{status: 500, message: "", err: err}
+	}
+	defer rows.Close()
+	var entries []Api_AuditEntryModel = []Api_AuditEntryModel{}
+	for rows.Next() {
+		var entry Api_AuditEntryModel
+		var timestamp string
+		var tagId sql.NullInt64
+		var before, after sql.NullString
+		err = rows.Scan(&entry.Id, &timestamp, &entry.KeyId, &entry.KeyLabel, &entry.Method, &entry.Route, &tagId, &before, &after)
+		if err != nil {
+			return nil, &DbResultError{status: 500, message: "", err: err}
+		}
+		entry.Timestamp, err = time.Parse(dbTimeLayout, timestamp)
+		if err != nil {
+			return nil, &DbResultError{status: 500, message: "", err: err}
+		}
+		if tagId.Valid {
+			id := int(tagId.Int64)
+			entry.TagId = &id
+		}
+		if before.Valid {
+			json.Unmarshal([]byte(before.String), &entry.Before)
+		}
+		if after.Valid {
+			json.Unmarshal([]byte(after.String), &entry.After)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -12,6 +12,10 @@ import (
 )
 
 var dbDateLayout = "2020-01-01 01:01:01"
+
+// Layout for timestamps in the service's own tables. Fixed width UTC so they compare correctly as text.
+const dbTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
 var db *sql.DB
 
 func dbInit(dbPath string) error {
@@ -31,6 +35,81 @@ func dbInit(dbPath string) error {
 	return nil
 }
 
+// Adds a column to a table created by an older version of the service
+func ensureColumn(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Reads a row of SELECT * FROM game
+func scanGame(rows *sql.Rows) (Game, error) {
+	var id string
+	var parentGameId, title, alternateTitles, series, developer, publisher sql.NullString
+	var dateAdded, dateModified string
+	var platform string
+	var broken, extreme bool
+	var playMode, status, notes, source string
+	var applicationPath, launchCommand, releaseDate, version string
+	var originalDescription, language, library, orderTitle string
+	var activeDataId, activeDataOnDisk sql.NullString
+	var tagsStr string
+	err := rows.Scan(&id, &parentGameId, &title, &alternateTitles, &series, &developer, &publisher,
+		&dateAdded, &dateModified,
+		&platform,
+		&broken, &extreme,
+		&playMode, &status, &notes, &source,
+		&applicationPath, &launchCommand, &releaseDate, &version,
+		&originalDescription, &language, &library, &orderTitle,
+		&activeDataId, &activeDataOnDisk,
+		&tagsStr)
+	if err != nil {
+		return Game{}, err
+	}
+	return Game{
+		Id:                  id,
+		Title:               nullStringToVal(title),
+		AlternateTitles:     nullStringToVal(alternateTitles),
+		Developer:           nullStringToVal(developer),
+		Publisher:           nullStringToVal(publisher),
+		Series:              nullStringToVal(series),
+		DateAdded:           dateAdded,
+		DateModified:        dateModified,
+		Platform:            platform,
+		PlayMode:            playMode,
+		Status:              status,
+		Notes:               notes,
+		Source:              source,
+		ApplicationPath:     applicationPath,
+		LaunchCommand:       launchCommand,
+		ReleaseDate:         releaseDate,
+		Version:             version,
+		OriginalDescription: originalDescription,
+		Language:            language,
+		Library:             library,
+		TagsStr:             tagsStr,
+		Extreme:             extreme,
+		Broken:              broken,
+	}, nil
+}
+
 func populateEs() (int, error) {
 	rows, err := db.Query("SELECT * FROM game")
 	if err != nil {
@@ -40,59 +119,18 @@ func populateEs() (int, error) {
 	var games []Game = []Game{}
 	for rows.Next() {
 		totalRows += 1
-		var id string
-		var parentGameId, title, alternateTitles, series, developer, publisher sql.NullString
-		var dateAdded, dateModified string
-		var platform string
-		var broken, extreme bool
-		var playMode, status, notes, source string
-		var applicationPath, launchCommand, releaseDate, version string
-		var originalDescription, language, library, orderTitle string
-		var activeDataId, activeDataOnDisk sql.NullString
-		var tagsStr string
-		err = rows.Scan(&id, &parentGameId, &title, &alternateTitles, &series, &developer, &publisher,
-			&dateAdded, &dateModified,
-			&platform,
-			&broken, &extreme,
-			&playMode, &status, &notes, &source,
-			&applicationPath, &launchCommand, &releaseDate, &version,
-			&originalDescription, &language, &library, &orderTitle,
-			&activeDataId, &activeDataOnDisk,
-			&tagsStr)
+		game, err := scanGame(rows)
 		if err != nil {
 			defer rows.Close()
 			return 0, err
 		}
-		game := Game{
-			Id:                  id,
-			Title:               nullStringToVal(title),
-			AlternateTitles:     nullStringToVal(alternateTitles),
-			Developer:           nullStringToVal(developer),
-			Publisher:           nullStringToVal(publisher),
-			Series:              nullStringToVal(series),
-			DateAdded:           dateAdded,
-			DateModified:        dateModified,
-			Platform:            platform,
-			PlayMode:            playMode,
-			Status:              status,
-			Notes:               notes,
-			Source:              source,
-			ApplicationPath:     applicationPath,
-			LaunchCommand:       launchCommand,
-			ReleaseDate:         releaseDate,
-			Version:             version,
-			OriginalDescription: originalDescription,
-			Language:            language,
-			TagsStr:             tagsStr,
-		}
 		games = append(games, game)
-		if err != nil {
-			defer rows.Close()
-			return 0, err
-		}
 	}
 	defer rows.Close()
-	indexGames(games)
+	err = searchBackend.IndexGames(games)
+	if err != nil {
+		return 0, err
+	}
 	return totalRows, nil
 }
 
@@ -126,6 +164,24 @@ func _getTagAlias(name string) (*TagAliasModel, *DbResultError) {
 	return &alias, nil
 }
 
+// Returns every alias of the tag the given alias belongs to, or just the name if it isn't a known alias
+func getTagAliasNames(name string) ([]string, *DbResultError) {
+	alias, dbErr := _getTagAlias(name)
+	if dbErr != nil {
+		if dbErr.status == 404 {
+			return []string{name}, nil
+		}
+		return nil, dbErr
+	}
+	tag, dbErr := getTagById(alias.tagId)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	names := []string{*tag.PrimaryAlias}
+	names = append(names, *tag.Aliases...)
+	return names, nil
+}
+
 func _createTagAlias(name string, tagId int, tx *sql.Tx) (int, *DbResultError) {
 	res, err := tx.Exec("INSERT INTO tag_alias (tagId, name) VALUES (?, ?)", tagId, name)
 	if err != nil {
@@ -225,25 +281,37 @@ func getTagByName(name string) (*Api_TagModel, *DbResultError) {
 	}
 }
 
+// Satisfied by both *sql.DB and *sql.Tx, so reads can see a transaction's own writes
+type dbQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
 func getTagById(id int) (*Api_TagModel, *DbResultError) {
+	return getTagByIdFrom(db, id)
+}
+
+func getTagByIdFrom(q dbQuerier, id int) (*Api_TagModel, *DbResultError) {
 	// Find the Tag
-	rows, err := db.Query("SELECT * FROM tag WHERE tag.id = ?", id)
+	rows, err := q.Query("SELECT * FROM tag WHERE tag.id = ?", id)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			return nil, &DbResultError{status: 404, message: "Tag Not Found", err: nil}
 		}
 		return nil, &DbResultError{status: 500, message: "", err: err}
 	}
+	defer rows.Close()
 	rows.Next()
 	var dbTag TagModel
 	err = rows.Scan(&dbTag.id, &dbTag.dateModified, &dbTag.primaryAliasId, &dbTag.categoryId, &dbTag.description)
 	if err != nil {
 		return nil, &DbResultError{status: 500, message: "", err: err}
 	}
-	aliasRows, err := db.Query("SELECT * FROM tag_alias WHERE tag_alias.tagId = ?", dbTag.id)
+	rows.Close()
+	aliasRows, err := q.Query("SELECT * FROM tag_alias WHERE tag_alias.tagId = ?", dbTag.id)
 	if err != nil {
 		return nil, &DbResultError{status: 500, message: "", err: err}
 	}
+	defer aliasRows.Close()
 	// Find all aliases
 	var aliases []string
 	var pAlias string
@@ -296,7 +364,10 @@ func deleteTag(name string) *DbResultError {
 	return nil
 }
 
-func createTag(update Api_TagModel) *DbResultError {
+// Runs inside a tag write's transaction just before it commits, failing the write if it returns an error
+type tagWriteHook func(tx *sql.Tx, tagId int) *DbResultError
+
+func createTag(update Api_TagModel, beforeCommit tagWriteHook) *DbResultError {
 	if update.PrimaryAlias == nil {
 		return &DbResultError{status: 400, message: "Primary Alias Required", err: nil}
 	}
@@ -342,10 +413,10 @@ func createTag(update Api_TagModel) *DbResultError {
 	if err != nil {
 		return &DbResultError{status: 500, message: "", err: err}
 	}
-	return updateTag(int(tagId), update, tx)
+	return updateTag(int(tagId), update, tx, beforeCommit)
 }
 
-func updateTag(tagId int, update Api_TagModel, tx *sql.Tx) *DbResultError {
+func updateTag(tagId int, update Api_TagModel, tx *sql.Tx, beforeCommit tagWriteHook) *DbResultError {
 	rows, err := db.Query("SELECT * FROM tag WHERE tag.id = ?", tagId)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -369,7 +440,7 @@ func updateTag(tagId int, update Api_TagModel, tx *sql.Tx) *DbResultError {
 			return err
 		}
 		if !valid {
-			return nil
+			return &DbResultError{status: 400, message: fmt.Sprintf("Alias '%s' belongs to another tag", strings.TrimSpace(*update.PrimaryAlias)), err: nil}
 		}
 	}
 	// Aliases
@@ -380,7 +451,7 @@ func updateTag(tagId int, update Api_TagModel, tx *sql.Tx) *DbResultError {
 				return err
 			}
 			if !valid {
-				return nil
+				return &DbResultError{status: 400, message: fmt.Sprintf("Alias '%s' belongs to another tag", strings.TrimSpace(name)), err: nil}
 			}
 		}
 	}
@@ -391,8 +462,7 @@ func updateTag(tagId int, update Api_TagModel, tx *sql.Tx) *DbResultError {
 			return err
 		}
 		if newCategory == nil {
-			// Tag category doesn't exist
-			return nil
+			return &DbResultError{status: 400, message: fmt.Sprintf("Tag category '%s' doesn't exist", *update.Category), err: nil}
 		}
 	}
 	// -- Update Application --
@@ -402,6 +472,7 @@ func updateTag(tagId int, update Api_TagModel, tx *sql.Tx) *DbResultError {
 		if err != nil {
 			return &DbResultError{status: 500, message: "", err: err}
 		}
+		defer tx.Rollback()
 	}
 	if update.PrimaryAlias != nil {
 		existing, err := _getTagAlias(strings.TrimSpace(*update.PrimaryAlias))
@@ -495,6 +566,12 @@ func updateTag(tagId int, update Api_TagModel, tx *sql.Tx) *DbResultError {
 	if err != nil {
 		return &DbResultError{status: 500, message: "", err: err}
 	}
+	if beforeCommit != nil {
+		dbErr := beforeCommit(tx, tagId)
+		if dbErr != nil {
+			return dbErr
+		}
+	}
 	err = tx.Commit()
 	if err != nil {
 		return &DbResultError{status: 500, message: "", err: err}
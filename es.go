@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/elastic/go-elasticsearch/v7/esutil"
 	"github.com/mitchellh/mapstructure"
 )
@@ -25,26 +29,28 @@ func esInit(esUri string) error {
 		return err
 	}
 	log.Println(elasticsearch.Version)
+	// The cluster being down isn't fatal, searches fail over until it's back
 	info, err := client.Info()
 	if err != nil {
-		return err
+		log.Printf("Elasticsearch unavailable: %v", err)
+		return nil
 	}
 	log.Println(info)
 	return nil
 }
 
-func _indexGames(games []Game) error {
+func _indexGames(index string, games []Game) error {
 	ctx := context.Background()
 	cfg := esutil.BulkIndexerConfig{
 		Client: client,
-		Index:  "gameinfo",
+		Index:  index,
 	}
 	indexer, _ := esutil.NewBulkIndexer(cfg)
 	for _, workedGame := range games {
 		indexer.Add(ctx, esutil.BulkIndexerItem{
-			Index:  "gameinfo",
+			Index:  index,
 			Action: "index",
-			Body:   esutil.NewJSONReader(workedGame),
+			Body:   esutil.NewJSONReader(newGameDocument(workedGame)),
 		})
 	}
 	err := indexer.Close(ctx)
@@ -54,18 +60,32 @@ func _indexGames(games []Game) error {
 	return nil
 }
 
+// Builds a fresh index beside the one being served, then swaps the gameinfo alias over to it.
+// Searches keep answering from the old index until the swap. Cursor walks open at the time of
+// the swap end, since their point in time was taken on the old index.
 func indexGames(games []Game) error {
-	indicies := []string{"gameinfo"}
-	_, err := client.Indices.Delete(indicies)
+	index := fmt.Sprintf("gameinfo_%d", time.Now().UnixNano())
+	err := createGameinfoIndex(index)
+	if err != nil {
+		return err
+	}
+	err = fillIndex(index, games)
+	if err == nil {
+		err = swapGameinfoAlias(index)
+	}
 	if err != nil {
+		deleteIndex(index)
 		return err
 	}
-	client.Indices.Create("gameinfo")
+	return nil
+}
+
+func fillIndex(index string, games []Game) error {
 	var workingGames []Game
 	for _, game := range games {
 		workingGames = append(workingGames, game)
 		if len(workingGames) >= 1000 {
-			err := _indexGames(workingGames)
+			err := _indexGames(index, workingGames)
 			if err != nil {
 				return err
 			}
@@ -73,11 +93,20 @@ func indexGames(games []Game) error {
 		}
 	}
 	if len(workingGames) > 0 {
-		err := _indexGames(workingGames)
+		err := _indexGames(index, workingGames)
 		if err != nil {
 			return err
 		}
 	}
+	// Makes every game searchable before the alias points at it
+	res, err := client.Indices.Refresh(client.Indices.Refresh.WithIndex(index))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Response Error: %v", res)
+	}
 	return nil
 }
 
@@ -112,35 +141,144 @@ func _findGameById(id string) (*Game, error) {
 	return nil, nil
 }
 
-func search(gameSearch *GameSearch) ([]Game, float64, error) {
+// Weight given to each kind of likeness between games
+var relatedFieldBoosts = []struct {
+	field string
+	boost float64
+}{
+	{"tags", 3},
+	{"series", 2},
+	{"developer", 2},
+	{"originalDescription", 1},
+}
+
+// Finds games like the given one, excluding it, narrowed by the filters of gameSearch
+func _findRelatedGames(game *Game, gameSearch *GameSearch, limit int) ([]Game, error) {
 	ctx := context.Background()
+	// The game is given as its own document so this works whatever ids the index was built with
+	like := map[string]interface{}{
+		"_index": "gameinfo",
+		"doc": map[string]interface{}{
+			"tags":                splitList(game.TagsStr),
+			"series":              game.Series,
+			"developer":           game.Developer,
+			"originalDescription": game.OriginalDescription,
+		},
+	}
+	should := []interface{}{}
+	for _, related := range relatedFieldBoosts {
+		should = append(should, map[string]interface{}{
+			"more_like_this": map[string]interface{}{
+				"fields":          []string{related.field},
+				"like":            []interface{}{like},
+				"min_term_freq":   1,
+				"min_doc_freq":    1,
+				"max_query_terms": 25,
+				"boost":           related.boost,
+			},
+		})
+	}
+	filters, mustNot := buildGameFilters(gameSearch)
+	mustNot = append(mustNot, map[string]interface{}{
+		"term": map[string]interface{}{
+			"game_id": game.Id,
+		},
+	})
 	query := map[string]interface{}{
-		"size": gameSearch.Limit,
-		"from": (gameSearch.Page - 1) * gameSearch.Limit,
+		"size": limit,
 		"query": map[string]interface{}{
-			"query_string": map[string]interface{}{
-				"query": fmt.Sprintf("%s~%d", gameSearch.Query, gameSearch.Fuzz),
+			"bool": map[string]interface{}{
+				"should":               should,
+				"minimum_should_match": 1,
+				"filter":               filters,
+				"must_not":             mustNot,
 			},
 		},
-		"sort": [1]map[string]interface{}{
-			{gameSearch.Sort: gameSearch.Order},
-		},
 	}
-	reader := esutil.NewJSONReader(query)
 	res, err := client.Search(
 		client.Search.WithIndex("gameinfo"),
+		client.Search.WithBody(esutil.NewJSONReader(query)),
+		client.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+	if res.IsError() {
+		return nil, fmt.Errorf("Response Error: %v", body)
+	}
+	games := []Game{}
+	for _, hit := range body["hits"].(map[string]interface{})["hits"].([]interface{}) {
+		games = append(games, mapHitToGame(hit))
+	}
+	return games, nil
+}
+
+type SearchResult struct {
+	Games  []Game
+	Total  float64
+	Facets map[string][]FacetCount
+	// Token for the next page of a cursor walk, empty after the last page
+	Cursor string
+	// Set when a fallback answered in place of the configured backend
+	Degraded bool
+}
+
+func search(gameSearch *GameSearch) (*SearchResult, error) {
+	ctx := context.Background()
+	query := map[string]interface{}{
+		"size":  gameSearch.Limit,
+		"from":  (gameSearch.Page - 1) * gameSearch.Limit,
+		"query": buildGameQuery(gameSearch),
+		// Totals are otherwise capped at 10000, leaving last_page short for cursor walks of big sets
+		"track_total_hits": true,
+	}
+	sort, err := buildGameSort(gameSearch.Sort, gameSearch.Order)
+	if err != nil {
+		return nil, &SearchRequestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	query["sort"] = sort
+	if gameSearch.Highlight {
+		query["highlight"] = buildHighlight(gameSearch)
+	}
+	if len(gameSearch.Facets) > 0 {
+		query["aggs"] = buildFacetAggs(gameSearch.Facets)
+	}
+	var cursor *searchCursor
+	if gameSearch.Cursor != nil {
+		cursor, err = applyCursor(query, *gameSearch.Cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	reader := esutil.NewJSONReader(query)
+	options := []func(*esapi.SearchRequest){
 		client.Search.WithBody(reader),
 		client.Search.WithPretty(),
 		client.Search.WithContext(ctx),
-	)
+	}
+	// Searches of a point in time take the index from it
+	if cursor == nil {
+		options = append(options, client.Search.WithIndex("gameinfo"))
+	}
+	res, err := client.Search(options...)
 	if err != nil {
-		return nil, 0.0, err
+		return nil, err
 	}
 	defer res.Body.Close()
 	var body map[string]interface{}
 	json.NewDecoder(res.Body).Decode(&body)
+	if cursor != nil && res.StatusCode == http.StatusNotFound {
+		return nil, &SearchRequestError{status: http.StatusBadRequest, message: "Cursor Expired"}
+	}
+	// Lucene queries are written by the caller, so a query Elasticsearch can't parse is their mistake
+	if gameSearch.Mode == QueryModeLucene && res.StatusCode == http.StatusBadRequest {
+		return nil, &SearchRequestError{status: http.StatusBadRequest, message: "Invalid Query: " + esErrorReason(body)}
+	}
 	if res.IsError() {
-		return nil, 0.0, fmt.Errorf("Response Error: %v", body)
+		return nil, fmt.Errorf("Response Error: %v", body)
 	}
 	var games []Game
 	for _, hit := range body["hits"].(map[string]interface{})["hits"].([]interface{}) {
@@ -148,7 +286,14 @@ func search(gameSearch *GameSearch) ([]Game, float64, error) {
 		games = append(games, game)
 	}
 	total := body["hits"].(map[string]interface{})["total"].(map[string]interface{})["value"].(float64)
-	return games, total, nil
+	result := &SearchResult{Games: games, Total: total}
+	if cursor != nil {
+		result.Cursor = nextCursor(cursor, body, gameSearch.Limit)
+	}
+	if len(gameSearch.Facets) > 0 {
+		result.Facets = parseFacets(gameSearch.Facets, body["aggregations"])
+	}
+	return result, nil
 }
 
 func mapHitToGame(hit interface{}) Game {
@@ -156,5 +301,185 @@ func mapHitToGame(hit interface{}) Game {
 	source := hit.(map[string]interface{})["_source"]
 	mapstructure.Decode(source, &game)
 	game.Id = fmt.Sprintf("%v", source.(map[string]interface{})["game_id"])
+	if highlight, ok := hit.(map[string]interface{})["highlight"].(map[string]interface{}); ok {
+		game.Highlights = map[string][]string{}
+		for field, fragments := range highlight {
+			for _, fragment := range fragments.([]interface{}) {
+				game.Highlights[field] = append(game.Highlights[field], fmt.Sprintf("%v", fragment))
+			}
+		}
+	}
 	return game
 }
+
+// Completes a title prefix, returning each matching game once
+func suggestGames(prefix string, extreme bool, size int) ([]Api_GameSuggestionModel, error) {
+	ctx := context.Background()
+	contexts := []string{"false"}
+	if extreme {
+		contexts = append(contexts, "true")
+	}
+	query := map[string]interface{}{
+		// Suggestions come back alongside the hits, which aren't wanted here
+		"size":    0,
+		"_source": []string{"game_id", "title"},
+		"suggest": map[string]interface{}{
+			"titles": map[string]interface{}{
+				"prefix": prefix,
+				"completion": map[string]interface{}{
+					"field": "suggest",
+					// Games matching through several titles take one slot each, so ask for spares
+					"size": size * 2,
+					"contexts": map[string]interface{}{
+						"extreme": contexts,
+					},
+				},
+			},
+		},
+	}
+	res, err := client.Search(
+		client.Search.WithIndex("gameinfo"),
+		client.Search.WithBody(esutil.NewJSONReader(query)),
+		client.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+	if res.IsError() {
+		return nil, fmt.Errorf("Response Error: %v", body)
+	}
+	suggestions := []Api_GameSuggestionModel{}
+	seen := map[string]bool{}
+	for _, entry := range body["suggest"].(map[string]interface{})["titles"].([]interface{}) {
+		for _, option := range entry.(map[string]interface{})["options"].([]interface{}) {
+			game := mapHitToGame(option)
+			if seen[game.Id] || len(suggestions) >= size {
+				continue
+			}
+			seen[game.Id] = true
+			suggestions = append(suggestions, Api_GameSuggestionModel{
+				Id:    game.Id,
+				Title: game.Title,
+				Match: fmt.Sprintf("%v", option.(map[string]interface{})["text"]),
+			})
+		}
+	}
+	return suggestions, nil
+}
+
+// Digs the most specific explanation out of an Elasticsearch error response
+func esErrorReason(body map[string]interface{}) string {
+	esErr, _ := body["error"].(map[string]interface{})
+	reason, _ := esErr["reason"].(string)
+	if rootCauses, ok := esErr["root_cause"].([]interface{}); ok && len(rootCauses) > 0 {
+		if rootReason, ok := rootCauses[0].(map[string]interface{})["reason"].(string); ok {
+			reason = rootReason
+		}
+	}
+	if failedShards, ok := esErr["failed_shards"].([]interface{}); ok && len(failedShards) > 0 {
+		shardReason, _ := failedShards[0].(map[string]interface{})["reason"].(map[string]interface{})
+		if causedBy, ok := shardReason["caused_by"].(map[string]interface{}); ok {
+			if causeReason, ok := causedBy["reason"].(string); ok {
+				reason = causeReason
+			}
+		}
+	}
+	return reason
+}
+
+// Picks games matching the search at random. The same seed gives the same games for as long as the index is unchanged.
+func randomGames(gameSearch *GameSearch, count int, seed string) ([]Game, error) {
+	ctx := context.Background()
+	randomScore := map[string]interface{}{}
+	if seed != "" {
+		randomScore["seed"] = seed
+		// Hashing the game id keeps the picks stable across re-indexing, unlike the default _seq_no
+		randomScore["field"] = "game_id"
+	}
+	query := map[string]interface{}{
+		"size": count,
+		"query": map[string]interface{}{
+			"function_score": map[string]interface{}{
+				"query":        buildGameQuery(gameSearch),
+				"random_score": randomScore,
+				"boost_mode":   "replace",
+			},
+		},
+	}
+	res, err := client.Search(
+		client.Search.WithIndex("gameinfo"),
+		client.Search.WithBody(esutil.NewJSONReader(query)),
+		client.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+	if res.IsError() {
+		return nil, fmt.Errorf("Response Error: %v", body)
+	}
+	var games []Game
+	for _, hit := range body["hits"].(map[string]interface{})["hits"].([]interface{}) {
+		games = append(games, mapHitToGame(hit))
+	}
+	return games, nil
+}
+
+// Serves searches from the gameinfo index of an Elasticsearch cluster
+type esSearchBackend struct {
+	// 1 once checkGameinfoMapping has run
+	mappingChecked int32
+}
+
+func newEsSearchBackend(esUri string) (*esSearchBackend, error) {
+	err := esInit(esUri)
+	if err != nil {
+		return nil, err
+	}
+	return &esSearchBackend{}, nil
+}
+
+func (b *esSearchBackend) IndexGames(games []Game) error {
+	return indexGames(games)
+}
+
+func (b *esSearchBackend) Search(gameSearch *GameSearch) (*SearchResult, error) {
+	return search(gameSearch)
+}
+
+func (b *esSearchBackend) FindGameById(id string) (*Game, error) {
+	return _findGameById(id)
+}
+
+func (b *esSearchBackend) Health() error {
+	res, err := client.Ping(client.Ping.WithContext(context.Background()))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Response Error: %s", res.Status())
+	}
+	// The mapping is checked on first contact, which may come after startup
+	if atomic.CompareAndSwapInt32(&b.mappingChecked, 0, 1) {
+		checkGameinfoMapping()
+	}
+	return nil
+}
+
+func (b *esSearchBackend) SuggestGames(prefix string, extreme bool, size int) ([]Api_GameSuggestionModel, error) {
+	return suggestGames(prefix, extreme, size)
+}
+
+func (b *esSearchBackend) RandomGames(gameSearch *GameSearch, count int, seed string) ([]Game, error) {
+	return randomGames(gameSearch, count, seed)
+}
+
+func (b *esSearchBackend) RelatedGames(game *Game, gameSearch *GameSearch, limit int) ([]Game, error) {
+	return _findRelatedGames(game, gameSearch, limit)
+}
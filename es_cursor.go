@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+)
+
+// How long a point in time is kept open between the pages of a cursor walk
+const cursorKeepAlive = "5m"
+
+// Decoded form of the opaque cursor handed to clients
+type searchCursor struct {
+	PitId string        `json:"pit"`
+	After []interface{} `json:"after,omitempty"`
+	// Hash of the query and sort the walk was started with, as its sort values only fit those
+	Hash string `json:"hash"`
+}
+
+func searchHash(query map[string]interface{}) string {
+	raw, _ := json.Marshal([]interface{}{query["query"], query["sort"]})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:16])
+}
+
+func encodeCursor(cursor searchCursor) string {
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(token string) (*searchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, &SearchRequestError{status: http.StatusBadRequest, message: "Invalid Cursor"}
+	}
+	var cursor searchCursor
+	err = json.Unmarshal(raw, &cursor)
+	if err != nil || cursor.PitId == "" {
+		return nil, &SearchRequestError{status: http.StatusBadRequest, message: "Invalid Cursor"}
+	}
+	return &cursor, nil
+}
+
+func openPointInTime() (string, error) {
+	res, err := client.OpenPointInTime(
+		client.OpenPointInTime.WithIndex("gameinfo"),
+		client.OpenPointInTime.WithKeepAlive(cursorKeepAlive),
+		client.OpenPointInTime.WithContext(context.Background()),
+	)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+	if res.IsError() {
+		return "", fmt.Errorf("Response Error: %v", body)
+	}
+	return fmt.Sprintf("%v", body["id"]), nil
+}
+
+// Releases a point in time once a walk reaches the end, rather than waiting for it to expire
+func closePointInTime(pitId string) {
+	res, err := client.ClosePointInTime(
+		client.ClosePointInTime.WithBody(esutil.NewJSONReader(map[string]interface{}{"id": pitId})),
+		client.ClosePointInTime.WithContext(context.Background()),
+	)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+}
+
+// Turns a search into the next page of a cursor walk, opening a point in time for new walks
+func applyCursor(query map[string]interface{}, token string) (*searchCursor, error) {
+	var cursor *searchCursor
+	hash := searchHash(query)
+	if token == "" {
+		pitId, err := openPointInTime()
+		if err != nil {
+			return nil, err
+		}
+		cursor = &searchCursor{PitId: pitId, Hash: hash}
+	} else {
+		var err error
+		cursor, err = decodeCursor(token)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.Hash != hash {
+			return nil, &SearchRequestError{status: http.StatusBadRequest, message: "Cursor does not match the search, the query, filters and sort must stay the same"}
+		}
+	}
+	delete(query, "from")
+	query["pit"] = map[string]interface{}{
+		"id":         cursor.PitId,
+		"keep_alive": cursorKeepAlive,
+	}
+	if len(cursor.After) > 0 {
+		query["search_after"] = cursor.After
+	}
+	return cursor, nil
+}
+
+// Works out the cursor for the page after the one in body, empty once there are no more results
+func nextCursor(cursor *searchCursor, body map[string]interface{}, limit int) string {
+	if pitId, ok := body["pit_id"].(string); ok {
+		cursor.PitId = pitId
+	}
+	hits := body["hits"].(map[string]interface{})["hits"].([]interface{})
+	if len(hits) < limit || len(hits) == 0 {
+		closePointInTime(cursor.PitId)
+		return ""
+	}
+	after, _ := hits[len(hits)-1].(map[string]interface{})["sort"].([]interface{})
+	return encodeCursor(searchCursor{PitId: cursor.PitId, After: after, Hash: cursor.Hash})
+}
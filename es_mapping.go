@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+)
+
+// Bump whenever gameinfoIndex changes, so outdated indices can be spotted and rebuilt
+const gameinfoMappingVersion = 1
+
+// Formats the game table has stored dates in over time
+const gameDateFormats = "strict_date_optional_time||yyyy-MM-dd HH:mm:ss.SSS||yyyy-MM-dd HH:mm:ss||epoch_millis"
+
+// Release dates are as precise as is known about the game
+const releaseDateFormats = "yyyy-MM-dd||yyyy-MM||yyyy"
+
+func textField(analyzer string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "text",
+		"analyzer": analyzer,
+	}
+}
+
+// Text which can also be matched and counted exactly through its keyword subfield
+func textKeywordField(analyzer string) map[string]interface{} {
+	field := textField(analyzer)
+	field["fields"] = map[string]interface{}{
+		"keyword": map[string]interface{}{
+			"type":         "keyword",
+			"ignore_above": 256,
+		},
+	}
+	return field
+}
+
+func keywordField() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "keyword",
+	}
+}
+
+func dateField(format string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":   "date",
+		"format": format,
+		// Games with dates that can't be read are still indexed, just without the date being searchable
+		"ignore_malformed": true,
+	}
+}
+
+// Settings and mappings the gameinfo index is created with
+var gameinfoIndex = map[string]interface{}{
+	"settings": map[string]interface{}{
+		"analysis": map[string]interface{}{
+			"normalizer": map[string]interface{}{
+				// Sorts "Árbol" with "arbol" rather than after "zebra"
+				"sort": map[string]interface{}{
+					"type":   "custom",
+					"filter": []string{"lowercase", "asciifolding"},
+				},
+			},
+			"filter": map[string]interface{}{
+				"english_stop": map[string]interface{}{
+					"type":      "stop",
+					"stopwords": "_english_",
+				},
+				"english_stemmer": map[string]interface{}{
+					"type":     "stemmer",
+					"language": "english",
+				},
+			},
+			"analyzer": map[string]interface{}{
+				// Names and titles, matched word for word
+				"folded": map[string]interface{}{
+					"type":      "custom",
+					"tokenizer": "standard",
+					"filter":    []string{"lowercase", "asciifolding"},
+				},
+				// Prose, where "jumping" should find "jumps"
+				"description": map[string]interface{}{
+					"type":      "custom",
+					"tokenizer": "standard",
+					"filter":    []string{"lowercase", "asciifolding", "english_stop", "english_stemmer"},
+				},
+			},
+		},
+	},
+	"mappings": map[string]interface{}{
+		"_meta": map[string]interface{}{
+			"version": gameinfoMappingVersion,
+		},
+		"properties": map[string]interface{}{
+			"game_id": keywordField(),
+			"title": map[string]interface{}{
+				"type":     "text",
+				"analyzer": "folded",
+				"fields": map[string]interface{}{
+					"sort": map[string]interface{}{
+						"type":       "keyword",
+						"normalizer": "sort",
+					},
+				},
+			},
+			"alternateTitles":     textField("folded"),
+			"developer":           textKeywordField("folded"),
+			"publisher":           textKeywordField("folded"),
+			"series":              textKeywordField("folded"),
+			"dateAdded":           dateField(gameDateFormats),
+			"dateModified":        dateField(gameDateFormats),
+			"platform":            keywordField(),
+			"playMode":            textField("folded"),
+			"status":              textField("folded"),
+			"notes":               textField("description"),
+			"source":              textField("folded"),
+			"applicationPath":     map[string]interface{}{"type": "keyword", "index": false},
+			"launchCommand":       map[string]interface{}{"type": "keyword", "index": false},
+			"releaseDate":         dateField(releaseDateFormats),
+			"version":             keywordField(),
+			"originalDescription": textField("description"),
+			"language":            textField("folded"),
+			"library":             keywordField(),
+			"tagsStr":             textField("folded"),
+			"extreme":             map[string]interface{}{"type": "boolean"},
+			"broken":              map[string]interface{}{"type": "boolean"},
+			// The ';' separated fields above, split into values for exact filters and facets
+			"tags":        keywordField(),
+			"playModes":   keywordField(),
+			"statuses":    keywordField(),
+			"languages":   keywordField(),
+			"releaseYear": keywordField(),
+			// Titles completed by the suggest endpoint, tagged with whether the game is extreme so they can be left out
+			"suggest": map[string]interface{}{
+				"type": "completion",
+				"contexts": []interface{}{
+					map[string]interface{}{
+						"name": "extreme",
+						"type": "category",
+					},
+				},
+			},
+		},
+	},
+}
+
+// A game as stored in the index, with the fields only used for searching
+type gameDocument struct {
+	Game
+	Tags        []string         `json:"tags"`
+	PlayModes   []string         `json:"playModes"`
+	Statuses    []string         `json:"statuses"`
+	Languages   []string         `json:"languages"`
+	ReleaseYear string           `json:"releaseYear,omitempty"`
+	Suggest     gameSuggestField `json:"suggest"`
+}
+
+type gameSuggestField struct {
+	Input    []string            `json:"input"`
+	Contexts map[string][]string `json:"contexts"`
+}
+
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ";") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func newGameDocument(game Game) gameDocument {
+	doc := gameDocument{
+		Game:      game,
+		Tags:      splitList(game.TagsStr),
+		PlayModes: splitList(game.PlayMode),
+		Statuses:  splitList(game.Status),
+		Languages: splitList(game.Language),
+		Suggest: gameSuggestField{
+			Input: splitList(game.Title + ";" + game.AlternateTitles),
+			Contexts: map[string][]string{
+				"extreme": {strconv.FormatBool(game.Extreme)},
+			},
+		},
+	}
+	if len(game.ReleaseDate) >= 4 {
+		if _, err := strconv.Atoi(game.ReleaseDate[:4]); err == nil {
+			doc.ReleaseYear = game.ReleaseDate[:4]
+		}
+	}
+	return doc
+}
+
+// Warns when the gameinfo index was created by an older version of the service
+func checkGameinfoMapping() {
+	res, err := client.Indices.GetMapping(
+		client.Indices.GetMapping.WithIndex("gameinfo"),
+		client.Indices.GetMapping.WithContext(context.Background()),
+	)
+	if err != nil {
+		log.Printf("Error checking gameinfo mapping: %v", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		log.Printf("Error checking gameinfo mapping: %v", res)
+		return
+	}
+	var body map[string]struct {
+		Mappings struct {
+			Meta struct {
+				Version int `json:"version"`
+			} `json:"_meta"`
+		} `json:"mappings"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		log.Printf("Error checking gameinfo mapping: %v", err)
+		return
+	}
+	for name, index := range body {
+		if index.Mappings.Meta.Version != gameinfoMappingVersion {
+			log.Printf("Index %s has mapping version %d, expected %d. Re-index the games to update it.", name, index.Mappings.Meta.Version, gameinfoMappingVersion)
+		}
+	}
+}
+
+func createGameinfoIndex(name string) error {
+	res, err := client.Indices.Create(name, client.Indices.Create.WithBody(esutil.NewJSONReader(gameinfoIndex)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Response Error: %v", res)
+	}
+	return nil
+}
+
+// Names the indices searches of gameinfo currently reach, whether it's an alias or an index itself
+func gameinfoIndices() ([]string, error) {
+	res, err := client.Indices.Get([]string{"gameinfo"}, client.Indices.Get.WithIgnoreUnavailable(true))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return []string{}, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("Response Error: %v", res)
+	}
+	var body map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range body {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Points the gameinfo alias at the given index and removes the indices it replaces, in one step
+// so searches never find gameinfo missing. Indices from before gameinfo was an alias are replaced too.
+func swapGameinfoAlias(name string) error {
+	old, err := gameinfoIndices()
+	if err != nil {
+		return err
+	}
+	actions := []interface{}{
+		map[string]interface{}{"add": map[string]interface{}{"index": name, "alias": "gameinfo"}},
+	}
+	for _, index := range old {
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": index}})
+	}
+	res, err := client.Indices.UpdateAliases(esutil.NewJSONReader(map[string]interface{}{"actions": actions}))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Response Error: %v", res)
+	}
+	return nil
+}
+
+func deleteIndex(name string) {
+	res, err := client.Indices.Delete([]string{name})
+	if err != nil {
+		log.Printf("Error deleting index %s: %v", name, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		log.Printf("Error deleting index %s: %v", name, res)
+	}
+}
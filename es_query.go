@@ -0,0 +1,534 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type DateRange struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// How a GameSearch filter is matched against the index
+type gameFilterField struct {
+	path string
+	// Exact matches against a keyword field, otherwise a phrase anywhere in a text field
+	exact bool
+}
+
+var gameFilterFields = map[string]gameFilterField{
+	"platform":  {path: "platform", exact: true},
+	"library":   {path: "library", exact: true},
+	"playMode":  {path: "playModes", exact: true},
+	"status":    {path: "statuses", exact: true},
+	"language":  {path: "languages", exact: true},
+	"developer": {path: "developer"},
+	"publisher": {path: "publisher"},
+	"series":    {path: "series"},
+	"tags":      {path: "tags", exact: true},
+}
+
+// Range filters, keyed by the GameSearch field
+var gameRangeFields = map[string]string{
+	"dateAdded":   "dateAdded",
+	"releaseDate": "releaseDate",
+}
+
+// Index fields to sort by, keyed by the names accepted in GameSearch.Sort
+var gameSortFields = map[string]string{
+	"title":        "title.sort",
+	"dateAdded":    "dateAdded",
+	"dateModified": "dateModified",
+	"releaseDate":  "releaseDate",
+	"developer":    "developer.keyword",
+	"relevance":    "_score",
+}
+
+var gameSortNames = []string{"title", "dateAdded", "dateModified", "releaseDate", "developer", "relevance"}
+
+var searchDatePattern = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2}([T ][0-9:.]+(Z|[+-]\d{2}:?\d{2})?)?)?)?$`)
+
+func validateDateRange(name string, dateRange *DateRange) error {
+	if dateRange == nil {
+		return nil
+	}
+	for _, value := range []string{dateRange.From, dateRange.To} {
+		if value != "" && !searchDatePattern.MatchString(value) {
+			return fmt.Errorf("'%s' dates must look like YYYY, YYYY-MM, YYYY-MM-DD or an ISO 8601 time, got '%s'", name, value)
+		}
+	}
+	return nil
+}
+
+func validateGameSearch(gameSearch *GameSearch) error {
+	switch gameSearch.Mode {
+	case QueryModeSimple, QueryModePhrase, QueryModeLucene:
+	default:
+		return fmt.Errorf("'mode' must be of ('%s', '%s', '%s')", QueryModeSimple, QueryModePhrase, QueryModeLucene)
+	}
+	_, err := searchProfile(gameSearch.Profile)
+	if err != nil {
+		return err
+	}
+	if gameSearch.Mode == QueryModeLucene && hasLuceneTagTerm(gameSearch.Query) {
+		// Would be read as a field the index doesn't have, matching nothing
+		return errors.New("tag: terms aren't supported in lucene mode, use 'includeTags' instead")
+	}
+	if gameSearch.Page < 1 {
+		return fmt.Errorf("'page' must be at least 1, got %d", gameSearch.Page)
+	}
+	if gameSearch.Limit < 1 || gameSearch.Limit > maxSearchLimit {
+		return fmt.Errorf("'limit' must be between 1 and %d, got %d", maxSearchLimit, gameSearch.Limit)
+	}
+	if gameSearch.Cursor == nil && gameSearch.Page*gameSearch.Limit > maxSearchWindow {
+		return fmt.Errorf("Pages can only reach the first %d results, use a cursor to go further", maxSearchWindow)
+	}
+	err = validateDateRange("dateAdded", gameSearch.DateAdded)
+	if err != nil {
+		return err
+	}
+	err = validateDateRange("releaseDate", gameSearch.ReleaseDate)
+	if err != nil {
+		return err
+	}
+	_, err = parseGameSort(gameSearch.Sort, gameSearch.Order)
+	if err != nil {
+		return err
+	}
+	return validateFacets(gameSearch.Facets)
+}
+
+// Matches games with any of the values in the field
+func filterClause(name string, values []string) map[string]interface{} {
+	field := gameFilterFields[name]
+	if field.exact {
+		return map[string]interface{}{
+			"terms": map[string]interface{}{
+				field.path: values,
+			},
+		}
+	}
+	var should []interface{}
+	for _, value := range values {
+		should = append(should, phraseClause(field.path, value))
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should":               should,
+			"minimum_should_match": 1,
+		},
+	}
+}
+
+func phraseClause(path string, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"match_phrase": map[string]interface{}{
+			path: value,
+		},
+	}
+}
+
+// Elasticsearch fills in a partial date with the start of the period, so "2010" alone would end the
+// range on 2010-01-01. Date math rounding to the bound's precision takes in the whole of the period.
+func roundedUpDate(date string) string {
+	switch len(date) {
+	case len("2006"):
+		return date + "||/y"
+	case len("2006-01"):
+		return date + "||/M"
+	case len("2006-01-02"):
+		return date + "||/d"
+	}
+	return date
+}
+
+func rangeClause(name string, dateRange *DateRange) map[string]interface{} {
+	bounds := map[string]interface{}{}
+	if dateRange.From != "" {
+		bounds["gte"] = dateRange.From
+	}
+	if dateRange.To != "" {
+		bounds["lte"] = roundedUpDate(dateRange.To)
+	}
+	return map[string]interface{}{
+		"range": map[string]interface{}{
+			gameRangeFields[name]: bounds,
+		},
+	}
+}
+
+// Builds the bool filter and must_not clauses for the structured filters of a search
+func buildGameFilters(gameSearch *GameSearch) ([]interface{}, []interface{}) {
+	filters := []interface{}{}
+	mustNot := []interface{}{}
+	for _, filter := range []struct {
+		name   string
+		values []string
+	}{
+		{"platform", gameSearch.Platform},
+		{"playMode", gameSearch.PlayMode},
+		{"status", gameSearch.Status},
+		{"language", gameSearch.Language},
+		{"library", gameSearch.Library},
+		{"developer", gameSearch.Developer},
+		{"publisher", gameSearch.Publisher},
+		{"series", gameSearch.Series},
+	} {
+		if len(filter.values) > 0 {
+			filters = append(filters, filterClause(filter.name, filter.values))
+		}
+	}
+	// Every included tag must be present, where the other filters match any of their values
+	for _, tag := range gameSearch.IncludeTags {
+		filters = append(filters, filterClause("tags", gameSearch.tagNames(tag)))
+	}
+	for _, tag := range gameSearch.ExcludeTags {
+		mustNot = append(mustNot, filterClause("tags", gameSearch.tagNames(tag)))
+	}
+	if !gameSearch.Extreme {
+		mustNot = append(mustNot, map[string]interface{}{
+			"term": map[string]interface{}{
+				"extreme": true,
+			},
+		})
+	}
+	if gameSearch.DateAdded != nil {
+		filters = append(filters, rangeClause("dateAdded", gameSearch.DateAdded))
+	}
+	if gameSearch.ReleaseDate != nil {
+		filters = append(filters, rangeClause("releaseDate", gameSearch.ReleaseDate))
+	}
+	return filters, mustNot
+}
+
+const (
+	QueryModeSimple = "simple"
+	QueryModePhrase = "phrase"
+	QueryModeLucene = "lucene"
+)
+
+// Characters simple_query_string would otherwise read as operators
+var simpleQueryEscaper = strings.NewReplacer(
+	`\`, `\\`, `+`, `\+`, `|`, `\|`, `-`, `\-`, `"`, `\"`, `*`, `\*`, `(`, `\(`, `)`, `\)`, `~`, `\~`,
+)
+
+// Builds the free text part of a search. Only lucene mode lets the caller write query syntax,
+// the others treat the query as plain words so it can't fail to parse.
+func buildTextQuery(gameSearch *GameSearch, profile *SearchProfile) map[string]interface{} {
+	fields := profile.queryFields()
+	switch gameSearch.Mode {
+	case QueryModePhrase:
+		return map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":   gameSearch.Query,
+				"fields":  fields,
+				"type":    "phrase",
+				"slop":    gameSearch.Fuzz,
+				"lenient": true,
+			},
+		}
+	case QueryModeLucene:
+		return map[string]interface{}{
+			"query_string": map[string]interface{}{
+				"query":  fmt.Sprintf("%s~%d", gameSearch.Query, gameSearch.Fuzz),
+				"fields": fields,
+				// Skips fields the query can't apply to, like fuzzy terms against dates
+				"lenient": true,
+			},
+		}
+	}
+	terms := strings.Fields(gameSearch.Query)
+	for i, term := range terms {
+		terms[i] = simpleQueryEscaper.Replace(term)
+		if gameSearch.Fuzz > 0 {
+			terms[i] += fmt.Sprintf("~%d", gameSearch.Fuzz)
+		}
+	}
+	return map[string]interface{}{
+		"simple_query_string": map[string]interface{}{
+			"query":            strings.Join(terms, " "),
+			"fields":           fields,
+			"default_operator": "and",
+			"flags":            "FUZZY|WHITESPACE|ESCAPE",
+			"lenient":          true,
+		},
+	}
+}
+
+// Builds the query clause of a search, combining the free text query with the structured filters
+func buildGameQuery(gameSearch *GameSearch) map[string]interface{} {
+	profile, err := searchProfile(gameSearch.Profile)
+	if err != nil {
+		// Already refused by validateGameSearch, unless the config was reloaded in between
+		profile = &defaultSearchProfile
+	}
+	var must interface{}
+	if gameSearch.Query != "" {
+		must = buildTextQuery(gameSearch, profile)
+	} else {
+		must = map[string]interface{}{
+			"match_all": map[string]interface{}{},
+		}
+	}
+	filters, mustNot := buildGameFilters(gameSearch)
+	query := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must":     must,
+			"filter":   filters,
+			"must_not": mustNot,
+		},
+	}
+	functions := profile.scoreFunctions()
+	if len(functions) == 0 {
+		return query
+	}
+	return map[string]interface{}{
+		"function_score": map[string]interface{}{
+			"query":      query,
+			"functions":  functions,
+			"score_mode": "sum",
+			"boost_mode": "multiply",
+		},
+	}
+}
+
+// Number of values returned for each facet
+const facetSize = 20
+
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Index fields counted by each facet
+var gameFacets = map[string]string{
+	"platform":    "platform",
+	"library":     "library",
+	"developer":   "developer.keyword",
+	"playMode":    "playModes",
+	"language":    "languages",
+	"tags":        "tags",
+	"releaseYear": "releaseYear",
+}
+
+func validateFacets(facets []string) error {
+	for _, name := range facets {
+		if _, ok := gameFacets[name]; !ok {
+			names := make([]string, 0, len(gameFacets))
+			for known := range gameFacets {
+				names = append(names, known)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("Unknown facet '%s', must be of ('%s')", name, strings.Join(names, "', '"))
+		}
+	}
+	return nil
+}
+
+func buildFacetAggs(facets []string) map[string]interface{} {
+	aggs := map[string]interface{}{}
+	for _, name := range facets {
+		aggs[name] = map[string]interface{}{
+			"terms": map[string]interface{}{
+				"field": gameFacets[name],
+				"size":  facetSize,
+			},
+		}
+	}
+	return aggs
+}
+
+// Reads the facet counts out of the aggregations of a search response
+func parseFacets(facets []string, aggregations interface{}) map[string][]FacetCount {
+	result := map[string][]FacetCount{}
+	aggs, _ := aggregations.(map[string]interface{})
+	for _, name := range facets {
+		agg, _ := aggs[name].(map[string]interface{})
+		buckets, _ := agg["buckets"].([]interface{})
+		counts := []FacetCount{}
+		for _, rawBucket := range buckets {
+			bucket, _ := rawBucket.(map[string]interface{})
+			count, _ := bucket["doc_count"].(float64)
+			counts = append(counts, FacetCount{Value: fmt.Sprintf("%v", bucket["key"]), Count: int(count)})
+		}
+		result[name] = counts
+	}
+	return result
+}
+
+func buildHighlight(gameSearch *GameSearch) map[string]interface{} {
+	// Titles are short enough to show whole, descriptions are cut down to the parts around the matches
+	whole := map[string]interface{}{
+		"number_of_fragments": 0,
+	}
+	fragments := map[string]interface{}{
+		"fragment_size":       150,
+		"number_of_fragments": 3,
+	}
+	return map[string]interface{}{
+		// Snippets are meant to be shown as HTML, so the game text around the tags is escaped
+		"encoder":   "html",
+		"pre_tags":  []string{gameSearch.HighlightPreTag},
+		"post_tags": []string{gameSearch.HighlightPostTag},
+		"fields": map[string]interface{}{
+			"title":               whole,
+			"alternateTitles":     whole,
+			"originalDescription": fragments,
+			"notes":               fragments,
+		},
+	}
+}
+
+type gameSortKey struct {
+	name  string
+	order string
+}
+
+// Reads a sort list like "releaseDate:desc,title:asc".
+// Keys without an order use defaultOrder, except relevance which defaults to best first.
+func parseGameSort(sort string, defaultOrder string) ([]gameSortKey, error) {
+	if defaultOrder != "asc" && defaultOrder != "desc" {
+		return nil, fmt.Errorf("'order' must be of ('asc', 'desc'), got '%s'", defaultOrder)
+	}
+	keys := []gameSortKey{}
+	for _, key := range strings.Split(sort, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		name, order := key, defaultOrder
+		if name == "relevance" {
+			// Best matches first unless asked otherwise, whatever the order of the other keys
+			order = "desc"
+		}
+		if i := strings.Index(key, ":"); i >= 0 {
+			name, order = strings.TrimSpace(key[:i]), strings.TrimSpace(key[i+1:])
+			if order != "asc" && order != "desc" {
+				return nil, fmt.Errorf("Sort order for '%s' must be of ('asc', 'desc'), got '%s'", name, order)
+			}
+		}
+		if _, ok := gameSortFields[name]; !ok {
+			return nil, fmt.Errorf("Cannot sort by '%s', must be of ('%s')", name, strings.Join(gameSortNames, "', '"))
+		}
+		keys = append(keys, gameSortKey{name: name, order: order})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("'sort' must name at least one field")
+	}
+	return keys, nil
+}
+
+func buildGameSort(sort string, defaultOrder string) ([]interface{}, error) {
+	keys, err := parseGameSort(sort, defaultOrder)
+	if err != nil {
+		return nil, err
+	}
+	clauses := []interface{}{}
+	for _, key := range keys {
+		clauses = append(clauses, map[string]interface{}{
+			gameSortFields[key.name]: map[string]interface{}{
+				"order": key.order,
+			},
+		})
+	}
+	return clauses, nil
+}
+
+// Longest tag name, in words, tried when reading an unquoted tag: term
+const maxTagTermWords = 6
+
+// Pulls tag:Name terms out of the query, reading as many words as make up a known tag alias.
+// Names with quotes, like tag:"Point and Click", are taken as written.
+func extractTagTerms(query string) (string, []string, *DbResultError) {
+	words := strings.Fields(query)
+	var rest, tags []string
+	for i := 0; i < len(words); i++ {
+		if !strings.HasPrefix(strings.ToLower(words[i]), "tag:") || len(words[i]) == len("tag:") {
+			rest = append(rest, words[i])
+			continue
+		}
+		words[i] = words[i][len("tag:"):]
+		if strings.HasPrefix(words[i], `"`) {
+			end := i
+			for end < len(words)-1 && !strings.HasSuffix(words[end], `"`) {
+				end++
+			}
+			tags = append(tags, strings.Trim(strings.Join(words[i:end+1], " "), `"`))
+			i = end
+			continue
+		}
+		length := 1
+		for n := maxTagTermWords; n > 1; n-- {
+			if i+n > len(words) {
+				continue
+			}
+			alias, dbErr := _getTagAlias(strings.Join(words[i:i+n], " "))
+			if dbErr != nil && dbErr.status != 404 {
+				return "", nil, dbErr
+			}
+			if alias != nil {
+				length = n
+				break
+			}
+		}
+		tags = append(tags, strings.Join(words[i:i+length], " "))
+		i += length - 1
+	}
+	return strings.Join(rest, " "), tags, nil
+}
+
+// Reports whether a lucene query has a tag: term outside of a quoted phrase
+func hasLuceneTagTerm(query string) bool {
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		switch {
+		case query[i] == '\\':
+			i++
+		case query[i] == '"':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(strings.ToLower(query[i:]), "tag:"):
+			if i == 0 || strings.ContainsRune(" \t\n(+-!", rune(query[i-1])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Moves tag: terms out of the query into the included tags, then looks up every alias of the tags
+// being filtered on so games are matched whichever alias they were stored with
+func resolveTagAliases(gameSearch *GameSearch) *DbResultError {
+	// Lucene queries are left as written, validateGameSearch has already refused tag: terms in them
+	if gameSearch.Mode != QueryModeLucene {
+		query, tags, dbErr := extractTagTerms(gameSearch.Query)
+		if dbErr != nil {
+			return dbErr
+		}
+		gameSearch.Query = query
+		gameSearch.IncludeTags = append(gameSearch.IncludeTags, tags...)
+	}
+	gameSearch.tagAliases = map[string][]string{}
+	for _, tag := range append(append([]string{}, gameSearch.IncludeTags...), gameSearch.ExcludeTags...) {
+		if _, ok := gameSearch.tagAliases[tag]; ok {
+			continue
+		}
+		names, dbErr := getTagAliasNames(tag)
+		if dbErr != nil {
+			return dbErr
+		}
+		gameSearch.tagAliases[tag] = names
+	}
+	return nil
+}
+
+// Every alias of a tag, or just the tag itself if its aliases weren't looked up
+func (gameSearch *GameSearch) tagNames(tag string) []string {
+	if names, ok := gameSearch.tagAliases[tag]; ok {
+		return names
+	}
+	return []string{tag}
+}
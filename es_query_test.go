@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+func TestParseGameSort(t *testing.T) {
+	tests := []struct {
+		name    string
+		sort    string
+		order   string
+		want    []gameSortKey
+		wantErr string
+	}{
+		{"single key", "title", "asc", []gameSortKey{{"title", "asc"}}, ""},
+		{"default order applies", "title,releaseDate", "desc", []gameSortKey{{"title", "desc"}, {"releaseDate", "desc"}}, ""},
+		{"explicit orders", " releaseDate:desc , title:asc ", "asc", []gameSortKey{{"releaseDate", "desc"}, {"title", "asc"}}, ""},
+		{"relevance defaults to best first", "relevance,title", "asc", []gameSortKey{{"relevance", "desc"}, {"title", "asc"}}, ""},
+		{"relevance can be reversed", "relevance:asc", "asc", []gameSortKey{{"relevance", "asc"}}, ""},
+		{"empty keys are skipped", "title,,", "asc", []gameSortKey{{"title", "asc"}}, ""},
+		{"bad default order", "title", "up", nil, "'order' must be of ('asc', 'desc'), got 'up'"},
+		{"bad key order", "title:up", "asc", nil, "Sort order for 'title' must be of ('asc', 'desc'), got 'up'"},
+		{"no keys", " , ", "asc", nil, "'sort' must name at least one field"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := parseGameSort(test.sort, test.order)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			if !reflect.DeepEqual(keys, test.want) {
+				t.Fatalf("got %v, want %v", keys, test.want)
+			}
+		})
+	}
+	_, err := parseGameSort("nope", "asc")
+	if err == nil {
+		t.Fatal("want an unknown field to be rejected")
+	}
+}
+
+func TestValidateGameSearchPaging(t *testing.T) {
+	tests := []struct {
+		name    string
+		page    int
+		limit   int
+		cursor  bool
+		wantErr string
+	}{
+		{"first page", 1, 100, false, ""},
+		{"last page in the window", 10, 1000, false, ""},
+		{"page zero", 0, 100, false, "'page' must be at least 1, got 0"},
+		{"negative page", -1, 100, false, "'page' must be at least 1, got -1"},
+		{"limit zero", 1, 0, false, "'limit' must be between 1 and 1000, got 0"},
+		{"limit over max", 1, 1001, false, "'limit' must be between 1 and 1000, got 1001"},
+		{"past the window", 101, 100, false, "Pages can only reach the first 10000 results, use a cursor to go further"},
+		{"cursor past the window", 101, 100, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gameSearch := GameSearch{Mode: QueryModeSimple, Page: test.page, Limit: test.limit, Sort: "title", Order: "asc"}
+			if test.cursor {
+				cursor := "abc"
+				gameSearch.Cursor = &cursor
+			}
+			err := validateGameSearch(&gameSearch)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHasLuceneTagTerm(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"tag:Puzzle", true},
+		{"title:mario AND tag:Puzzle", true},
+		{"(TAG:Puzzle OR tag:Action)", true},
+		{"-tag:Puzzle", true},
+		{`"tag:Puzzle"`, false},
+		{`title:"the tag:Puzzle" tags:Action`, false},
+		{`\" tag:Puzzle`, true},
+		{"hashtag:x", false},
+		{"tags:Puzzle", false},
+	}
+	for _, test := range tests {
+		if got := hasLuceneTagTerm(test.query); got != test.want {
+			t.Errorf("hasLuceneTagTerm(%q) = %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestExtractTagTerms(t *testing.T) {
+	tagDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tagDb.Close()
+	tagDb.SetMaxOpenConns(1)
+	_, err = tagDb.Exec(`CREATE TABLE tag_alias (id INTEGER PRIMARY KEY, tagId INTEGER, name TEXT);
+		INSERT INTO tag_alias (tagId, name) VALUES (1, 'Puzzle'), (2, 'Point and Click'), (3, 'Point')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = tagDb
+	defer func() { db = nil }()
+
+	tests := []struct {
+		name      string
+		query     string
+		wantQuery string
+		wantTags  []string
+	}{
+		{"no tags", "super mario", "super mario", nil},
+		{"single word tag", "mario tag:Puzzle", "mario", []string{"Puzzle"}},
+		{"longest known alias wins", "tag:Point and Click adventure", "adventure", []string{"Point and Click"}},
+		{"shorter alias when the longer doesn't match", "tag:Point and shoot", "and shoot", []string{"Point"}},
+		{"unknown tag takes one word", "tag:Racing cars", "cars", []string{"Racing"}},
+		{"quoted tag", `tag:"Visual Novel" romance`, "romance", []string{"Visual Novel"}},
+		{"case-insensitive prefix", "TAG:Puzzle", "", []string{"Puzzle"}},
+		{"bare prefix is kept", "tag: mario", "tag: mario", nil},
+		{"several tags", "tag:Puzzle tag:Point and Click", "", []string{"Puzzle", "Point and Click"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, tags, dbErr := extractTagTerms(test.query)
+			if dbErr != nil {
+				t.Fatalf("got error %v", dbErr.err)
+			}
+			if query != test.wantQuery || !reflect.DeepEqual(tags, test.wantTags) {
+				t.Fatalf("got %q, %q, want %q, %q", query, tags, test.wantQuery, test.wantTags)
+			}
+		})
+	}
+}
+
+func TestValidateGameSearchLuceneTags(t *testing.T) {
+	gameSearch := GameSearch{Mode: QueryModeLucene, Query: "title:mario AND tag:Puzzle", Page: 1, Limit: 10, Sort: "title", Order: "asc"}
+	err := validateGameSearch(&gameSearch)
+	if err == nil {
+		t.Fatal("want tag: terms to be refused in lucene mode")
+	}
+	gameSearch.Mode = QueryModeSimple
+	err = validateGameSearch(&gameSearch)
+	if err != nil {
+		t.Fatalf("got error %q, want tag: terms to be allowed outside lucene mode", err)
+	}
+}
@@ -25,7 +25,12 @@ type Game struct {
 	Version             string `json:"version"`
 	OriginalDescription string `json:"originalDescription"`
 	Language            string `json:"language"`
+	Library             string `json:"library"`
 	TagsStr             string `json:"tagsStr"`
+	Extreme             bool   `json:"extreme"`
+	Broken              bool   `json:"broken"`
+	// Snippets of where a search matched, by field
+	Highlights map[string][]string `json:"highlights,omitempty"`
 }
 
 func returnAllGames(w http.ResponseWriter, r *http.Request) {
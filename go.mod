@@ -9,6 +9,6 @@ require (
 	github.com/gorilla/mux v1.8.0
 	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/mitchellh/mapstructure v1.4.1
-	github.com/tkanos/gonfig v0.0.0-20210106201359-53e13348de2f // indirect
+	github.com/tkanos/gonfig v0.0.0-20210106201359-53e13348de2f
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Used when the config doesn't set how much clock difference to allow when checking token times
+const defaultJwtLeeway = time.Minute
+
+type JwtConfig struct {
+	// JSON Web Key Set file holding the public keys tokens are signed with
+	JwksPath string `json:"JwksPath"`
+	// Required "iss" claim, if set
+	Issuer string `json:"Issuer"`
+	// Required entry in the "aud" claim, if set
+	Audience string `json:"Audience"`
+	// Claim holding the value mapped to a level, defaults to "role"
+	LevelClaim string `json:"LevelClaim"`
+	// Level claim value to one of ("generic", "write", "master")
+	Levels map[string]string `json:"Levels"`
+	// Allowed clock difference as a duration string, e.g. "1m"
+	Leeway string `json:"Leeway"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var jwksMu sync.RWMutex
+
+// Public keys by key id
+var jwksKeys map[string]crypto.PublicKey
+
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+func decodeBase64Int(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+func parseJwk(key jwk) (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBase64Int(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64Int(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", key.Crv)
+		}
+		x, err := decodeBase64Int(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64Int(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", key.Kty)
+}
+
+// Loads the JWKS file named in the config, clearing the keys if JWTs aren't configured
+func loadJwks() error {
+	keys, err := readJwks(currentConfig().Jwt)
+	if err != nil {
+		return err
+	}
+	jwksMu.Lock()
+	jwksKeys = keys
+	jwksMu.Unlock()
+	return nil
+}
+
+// Parses the JWKS file named in the JWT config, returning no keys if JWTs aren't configured
+func readJwks(jwtConfig *JwtConfig) (map[string]crypto.PublicKey, error) {
+	if jwtConfig == nil || jwtConfig.JwksPath == "" {
+		return nil, nil
+	}
+	raw, err := os.ReadFile(jwtConfig.JwksPath)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(raw, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := parseJwk(key)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key '%s': %v", key.Kid, err)
+		}
+		keys[key.Kid] = publicKey
+	}
+	return keys, nil
+}
+
+func findJwk(kid string) crypto.PublicKey {
+	jwksMu.RLock()
+	defer jwksMu.RUnlock()
+	if key, ok := jwksKeys[kid]; ok {
+		return key
+	}
+	// Tokens without a key id can only be matched when there's no choice to make
+	if kid == "" && len(jwksKeys) == 1 {
+		for _, key := range jwksKeys {
+			return key
+		}
+	}
+	return nil
+}
+
+func looksLikeJwt(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+func verifyJwtSignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) error {
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errors.New("algorithm does not match key")
+		}
+		return rsa.VerifyPKCS1v15(publicKey, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return errors.New("algorithm does not match key")
+		}
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key")
+}
+
+func audienceContains(aud interface{}, audience string) bool {
+	switch value := aud.(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, entry := range value {
+			if entry == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	value, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+// Checks a JWT against the JWKS keys and config, returning a record standing in for the token's user.
+// Returns nil with no error for valid tokens whose level claim doesn't map to a level.
+func verifyJwt(token string) (*ApiKeyRecord, error) {
+	jwtConfig := currentConfig().Jwt
+	if jwtConfig == nil {
+		return nil, errors.New("Invalid Token")
+	}
+	parts := strings.Split(token, ".")
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("Invalid Token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(rawHeader, &header)
+	if err != nil {
+		return nil, errors.New("Invalid Token")
+	}
+	key := findJwk(header.Kid)
+	if key == nil {
+		return nil, errors.New("Invalid Token: unknown signing key")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Invalid Token")
+	}
+	err = verifyJwtSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, errors.New("Invalid Token: " + err.Error())
+	}
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("Invalid Token")
+	}
+	var claims map[string]interface{}
+	err = json.Unmarshal(rawClaims, &claims)
+	if err != nil {
+		return nil, errors.New("Invalid Token")
+	}
+	leeway := defaultJwtLeeway
+	if jwtConfig.Leeway != "" {
+		leeway, err = time.ParseDuration(jwtConfig.Leeway)
+		if err != nil {
+			leeway = defaultJwtLeeway
+		}
+	}
+	now := time.Now()
+	expiresAt, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, errors.New("Invalid Token: missing exp claim")
+	}
+	if now.After(expiresAt.Add(leeway)) {
+		return nil, errors.New("Token Expired")
+	}
+	if notBefore, ok := numericClaim(claims, "nbf"); ok && now.Add(leeway).Before(notBefore) {
+		return nil, errors.New("Token Not Yet Valid")
+	}
+	if jwtConfig.Issuer != "" && claims["iss"] != jwtConfig.Issuer {
+		return nil, errors.New("Invalid Token: wrong issuer")
+	}
+	if jwtConfig.Audience != "" && !audienceContains(claims["aud"], jwtConfig.Audience) {
+		return nil, errors.New("Invalid Token: wrong audience")
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("Invalid Token: missing sub claim")
+	}
+	levelClaim := jwtConfig.LevelClaim
+	if levelClaim == "" {
+		levelClaim = "role"
+	}
+	claimValue, _ := claims[levelClaim].(string)
+	level, ok := jwtConfig.Levels[claimValue]
+	if !ok || levelScopes[level] == nil {
+		return nil, nil
+	}
+	issuer, _ := claims["iss"].(string)
+	return &ApiKeyRecord{
+		Id:    "jwt:" + subject,
+		Label: subject,
+		Owner: issuer,
+		Level: level,
+	}, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signTestJwt(t *testing.T, header map[string]interface{}, claims map[string]interface{}, key crypto.Signer) string {
+	rawHeader, _ := json.Marshal(header)
+	rawClaims, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(rawHeader) + "." + base64.RawURLEncoding.EncodeToString(rawClaims)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	var signature []byte
+	var err error
+	switch signer := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, signer, crypto.SHA256, digest.Sum(nil))
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, signer, digest.Sum(nil))
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJwt(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksKeys = map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey}
+	defer func() { jwksKeys = nil }()
+	config = ConfigFile{Jwt: &JwtConfig{
+		Issuer:   "https://issuer.example",
+		Audience: "gi",
+		Levels:   map[string]string{"editor": "write"},
+	}}
+	defer func() { config = ConfigFile{} }()
+
+	now := time.Now().Unix()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":  "user-1",
+			"iss":  "https://issuer.example",
+			"aud":  []interface{}{"other", "gi"},
+			"exp":  now + 60,
+			"role": "editor",
+		}
+	}
+	tests := []struct {
+		name      string
+		header    map[string]interface{}
+		claims    func() map[string]interface{}
+		key       crypto.Signer
+		wantErr   string
+		wantLevel string
+	}{
+		{"valid rsa", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, validClaims, rsaKey, "", "write"},
+		{"valid ec", map[string]interface{}{"alg": "ES256", "kid": "ec"}, validClaims, ecKey, "", "write"},
+		{"alg does not match key", map[string]interface{}{"alg": "ES256", "kid": "rsa"}, validClaims, rsaKey, "Invalid Token: algorithm does not match key", ""},
+		{"unsupported alg", map[string]interface{}{"alg": "HS256", "kid": "rsa"}, validClaims, rsaKey, "Invalid Token: unsupported algorithm 'HS256'", ""},
+		{"unknown key", map[string]interface{}{"alg": "RS256", "kid": "nope"}, validClaims, rsaKey, "Invalid Token: unknown signing key", ""},
+		{"signed by another key", map[string]interface{}{"alg": "ES256", "kid": "ec"}, validClaims, mustEcKey(t), "Invalid Token: invalid signature", ""},
+		{"missing exp", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, func() map[string]interface{} {
+			claims := validClaims()
+			delete(claims, "exp")
+			return claims
+		}, rsaKey, "Invalid Token: missing exp claim", ""},
+		{"expired", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, func() map[string]interface{} {
+			claims := validClaims()
+			claims["exp"] = now - 3600
+			return claims
+		}, rsaKey, "Token Expired", ""},
+		{"expired within leeway", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, func() map[string]interface{} {
+			claims := validClaims()
+			claims["exp"] = now - 30
+			return claims
+		}, rsaKey, "", "write"},
+		{"not yet valid", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, func() map[string]interface{} {
+			claims := validClaims()
+			claims["nbf"] = now + 3600
+			return claims
+		}, rsaKey, "Token Not Yet Valid", ""},
+		{"wrong issuer", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, func() map[string]interface{} {
+			claims := validClaims()
+			claims["iss"] = "https://elsewhere.example"
+			return claims
+		}, rsaKey, "Invalid Token: wrong issuer", ""},
+		{"wrong audience", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, func() map[string]interface{} {
+			claims := validClaims()
+			claims["aud"] = "other"
+			return claims
+		}, rsaKey, "Invalid Token: wrong audience", ""},
+		{"missing sub", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, func() map[string]interface{} {
+			claims := validClaims()
+			delete(claims, "sub")
+			return claims
+		}, rsaKey, "Invalid Token: missing sub claim", ""},
+		{"unmapped level claim", map[string]interface{}{"alg": "RS256", "kid": "rsa"}, func() map[string]interface{} {
+			claims := validClaims()
+			claims["role"] = "viewer"
+			return claims
+		}, rsaKey, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := signTestJwt(t, test.header, test.claims(), test.key)
+			record, err := verifyJwt(token)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			if test.wantLevel == "" {
+				if record != nil {
+					t.Fatalf("got record with level %q, want none", record.Level)
+				}
+				return
+			}
+			if record == nil || record.Level != test.wantLevel || record.Id != "jwt:user-1" {
+				t.Fatalf("got record %+v, want level %q for jwt:user-1", record, test.wantLevel)
+			}
+		})
+	}
+}
+
+func mustEcKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestReadJwksSkipsEncryptionKeys(t *testing.T) {
+	key := mustEcKey(t)
+	coordinate := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+	}
+	set := map[string]interface{}{"keys": []interface{}{
+		map[string]interface{}{"kty": "EC", "kid": "sig", "use": "sig", "crv": "P-256", "x": coordinate(key.X), "y": coordinate(key.Y)},
+		map[string]interface{}{"kty": "EC", "kid": "enc", "use": "enc", "crv": "P-256", "x": coordinate(key.X), "y": coordinate(key.Y)},
+	}}
+	raw, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	err := os.WriteFile(path, raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := readJwks(&JwtConfig{JwksPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys["sig"] == nil {
+		t.Fatalf("got keys %v, want only 'sig'", keys)
+	}
+	keys, err = readJwks(nil)
+	if err != nil || keys != nil {
+		t.Fatalf("got %v, %v, want no keys when JWTs aren't configured", keys, err)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Number of leading characters of a key kept in clear text so it can be recognised in listings
+const apiKeyPrefixLength = 8
+
+// How stale a key's lastUsed may get before the change is written back to the store
+const lastUsedResolution = time.Minute
+
+const (
+	ScopeGamesRead       = "games:read"
+	ScopeTagsRead        = "tags:read"
+	ScopeTagsWrite       = "tags:write"
+	ScopeCategoriesRead  = "categories:read"
+	ScopeCategoriesWrite = "categories:write"
+	ScopeKeysAdmin       = "keys:admin"
+)
+
+var allScopes = []string{ScopeGamesRead, ScopeTagsRead, ScopeTagsWrite, ScopeCategoriesRead, ScopeCategoriesWrite, ScopeKeysAdmin}
+
+// Scopes held by keys which were created with a level instead of an explicit scope list
+var levelScopes = map[string][]string{
+	"generic": {ScopeGamesRead, ScopeTagsRead, ScopeCategoriesRead},
+	"write":   {ScopeGamesRead, ScopeTagsRead, ScopeCategoriesRead, ScopeTagsWrite, ScopeCategoriesWrite},
+	"master":  allScopes,
+}
+
+// Stands in for the master key wherever a key record is expected
+var masterKeyRecord = ApiKeyRecord{Id: "master", Label: "master", Level: "master"}
+
+type ApiKeyRecord struct {
+	Id        string     `json:"id"`
+	Hash      string     `json:"hash"`
+	Prefix    string     `json:"prefix"`
+	Label     string     `json:"label"`
+	Owner     string     `json:"owner"`
+	Level     string     `json:"level"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Overrides the limits configured for the key's level
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	// Hex HMAC secret which write requests made with the key must be signed with
+	SigningSecret string `json:"signingSecret,omitempty"`
+	// Never shown extreme games, whatever the request asks for
+	SfwOnly bool `json:"sfwOnly,omitempty"`
+}
+
+// KeyStore holds the hashed api keys. Implementations must be safe for use from many goroutines.
+type KeyStore interface {
+	// Returns the record matching the raw key, or nil if there is none
+	Lookup(rawKey string) (*ApiKeyRecord, error)
+	Add(record ApiKeyRecord) error
+	// Removes the key with the given record id or raw key, returning false if it wasn't found
+	Revoke(id string) (bool, error)
+	List() ([]ApiKeyRecord, error)
+	// Returns the record with the given record id, or nil if there is none
+	Get(id string) (*ApiKeyRecord, error)
+	// Sets or clears the expiry of a key, returning false if it wasn't found
+	SetExpiry(id string, expiresAt *time.Time) (bool, error)
+	// Records that the key was used, persisting no more than once per lastUsedResolution
+	Touch(id string, at time.Time) error
+	// Picks up keys changed outside of the service
+	Reload() error
+}
+
+var keyStore KeyStore
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyPrefix(key string) string {
+	if len(key) <= apiKeyPrefixLength {
+		return key
+	}
+	return key[:apiKeyPrefixLength]
+}
+
+// Returns the explicit scopes of the key, falling back to those of its level
+func (k *ApiKeyRecord) effectiveScopes() []string {
+	if len(k.Scopes) > 0 {
+		return k.Scopes
+	}
+	return levelScopes[k.Level]
+}
+
+func (k *ApiKeyRecord) hasScope(scope string) bool {
+	for _, held := range k.effectiveScopes() {
+		if held == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *ApiKeyRecord) isExpired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+func isKnownScope(scope string) bool {
+	for _, known := range allScopes {
+		if known == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *ApiKeyRecord) toApiModel() Api_KeyModel {
+	return Api_KeyModel{
+		Id:        k.Id,
+		Prefix:    k.Prefix,
+		Label:     k.Label,
+		Owner:     k.Owner,
+		Level:     k.Level,
+		Scopes:    k.effectiveScopes(),
+		CreatedAt: k.CreatedAt,
+		LastUsed:  k.LastUsed,
+		ExpiresAt: k.ExpiresAt,
+		RateLimit: rateLimitFor(k),
+		Signed:    k.SigningSecret != "",
+		SfwOnly:   k.SfwOnly,
+	}
+}
+
+func newApiKeyRecord(rawKey string, level string, scopes []string, label string, owner string) ApiKeyRecord {
+	return ApiKeyRecord{
+		Id:        uuid.New().String(),
+		Hash:      hashApiKey(rawKey),
+		Prefix:    apiKeyPrefix(rawKey),
+		Label:     label,
+		Owner:     owner,
+		Level:     level,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// Generates a new key with the settings of template, stores its hash and returns the raw key.
+// The raw key is never stored. Signed keys are given a signing secret for write requests.
+func createApiKey(template ApiKeyRecord, signed bool) (string, *ApiKeyRecord, error) {
+	rawKey := uuid.New().String()
+	record := newApiKeyRecord(rawKey, template.Level, template.Scopes, template.Label, template.Owner)
+	record.ExpiresAt = template.ExpiresAt
+	record.RateLimit = template.RateLimit
+	record.SfwOnly = template.SfwOnly
+	if signed {
+		secret, err := newSigningSecret()
+		if err != nil {
+			return "", nil, err
+		}
+		record.SigningSecret = secret
+	}
+	err := keyStore.Add(record)
+	if err != nil {
+		return "", nil, err
+	}
+	return rawKey, &record, nil
+}
+
+// Issues a replacement for a key, keeping the old key valid for the grace period
+func createRotatedApiKey(old ApiKeyRecord, grace time.Duration, expiresAt *time.Time) (string, *ApiKeyRecord, error) {
+	template := old
+	template.ExpiresAt = expiresAt
+	rawKey, record, err := createApiKey(template, old.SigningSecret != "")
+	if err != nil {
+		return "", nil, err
+	}
+	// Never extend the life of a key which was already due to expire sooner
+	oldExpiry := time.Now().UTC().Add(grace)
+	if old.ExpiresAt != nil && old.ExpiresAt.Before(oldExpiry) {
+		oldExpiry = *old.ExpiresAt
+	}
+	_, err = keyStore.SetExpiry(old.Id, &oldExpiry)
+	if err != nil {
+		return "", nil, err
+	}
+	return rawKey, record, nil
+}
+
+func openKeyStore(backend string) (KeyStore, error) {
+	var store KeyStore
+	var err error
+	switch backend {
+	case "", "file":
+		store, err = newFileKeyStore("./api_keys.json")
+	case "sqlite":
+		store, err = newSqliteKeyStore(db)
+	default:
+		return nil, &UnknownBackendError{kind: "KeyStore", name: backend}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, importAllLegacyKeys(store)
+}
+
+func importAllLegacyKeys(store KeyStore) error {
+	for _, legacy := range []struct{ path, level string }{{"./write_keys", "write"}, {"./generic_keys", "generic"}} {
+		err := importLegacyKeys(store, legacy.path, legacy.level)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Left in the old key files once their keys are imported, as they no longer list the live keys
+const legacyKeyFileNotice = `# Keys added to this file are moved into the key store on the next reload, and removed from here.
+# Removing a key from here does not revoke it, use DELETE /api/key/{id} instead.
+`
+
+// Plaintext keys dropped into the old key files are hashed into the store, then the file is emptied.
+// The files are only an inbox for new keys, the store is what's checked on each request.
+func importLegacyKeys(store KeyStore, path string, level string) error {
+	raw_keys, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	imported := 0
+	unclean_keys := strings.Split(string(raw_keys), "\n")
+	for i := 0; i < len(unclean_keys); i++ {
+		clean_key := strings.TrimSpace(unclean_keys[i])
+		if clean_key == "" || strings.HasPrefix(clean_key, "#") {
+			continue
+		}
+		imported += 1
+		existing, err := store.Lookup(clean_key)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			err = store.Add(newApiKeyRecord(clean_key, level, nil, "Imported from "+path, ""))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if imported == 0 {
+		return nil
+	}
+	log.Printf("Moved %d key(s) from %s into the key store. Removing them from %s will not revoke them, use DELETE /api/key/{id}.", imported, path, path)
+	return os.WriteFile(path, []byte(legacyKeyFileNotice), 0600)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Keeps key records in a JSON file on local disk
+type fileKeyStore struct {
+	mu      sync.RWMutex
+	path    string
+	records []*ApiKeyRecord
+	// Stamp of the file as last read or written, to spot changes made by hand
+	stamp fileStamp
+}
+
+func newFileKeyStore(path string) (*fileKeyStore, error) {
+	store := &fileKeyStore{path: path, records: []*ApiKeyRecord{}}
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return store, store.save()
+	}
+	return store, store.load()
+}
+
+// Must be called with the write lock held
+func (s *fileKeyStore) load() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	records := []*ApiKeyRecord{}
+	// A file emptied by hand means no keys, not a broken store
+	if len(bytes.TrimSpace(raw)) > 0 {
+		err = json.Unmarshal(raw, &records)
+		if err != nil {
+			return err
+		}
+	}
+	s.records = records
+	s.stamp = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	return nil
+}
+
+func (s *fileKeyStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		// Keep serving the keys already loaded, the next save recreates the file
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if (fileStamp{modTime: info.ModTime(), size: info.Size()}) == s.stamp {
+		return nil
+	}
+	return s.load()
+}
+
+func (s *fileKeyStore) Lookup(rawKey string) (*ApiKeyRecord, error) {
+	hash := hashApiKey(rawKey)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, record := range s.records {
+		if record.Hash == hash {
+			found := *record
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *fileKeyStore) Add(record ApiKeyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, &record)
+	return s.save()
+}
+
+func (s *fileKeyStore) Revoke(id string) (bool, error) {
+	hash := hashApiKey(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, record := range s.records {
+		if record.Id == id || record.Hash == hash {
+			s.records = append(s.records[:i], s.records[i+1:]...)
+			return true, s.save()
+		}
+	}
+	return false, nil
+}
+
+func (s *fileKeyStore) List() ([]ApiKeyRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make([]ApiKeyRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, *record)
+	}
+	return records, nil
+}
+
+func (s *fileKeyStore) Get(id string) (*ApiKeyRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, record := range s.records {
+		if record.Id == id {
+			found := *record
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *fileKeyStore) SetExpiry(id string, expiresAt *time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range s.records {
+		if record.Id == id {
+			record.ExpiresAt = expiresAt
+			return true, s.save()
+		}
+	}
+	return false, nil
+}
+
+func (s *fileKeyStore) Touch(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range s.records {
+		if record.Id == id {
+			stale := record.LastUsed == nil || at.Sub(*record.LastUsed) >= lastUsedResolution
+			if !stale {
+				return nil
+			}
+			record.LastUsed = &at
+			return s.save()
+		}
+	}
+	return nil
+}
+
+// Must be called with the write lock held
+func (s *fileKeyStore) save() error {
+	content, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first so a crash can't leave a half written key store behind
+	tmpFile := s.path + ".tmp"
+	err = os.WriteFile(tmpFile, content, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile, s.path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.stamp = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	return nil
+}
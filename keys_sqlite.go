@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Keeps key records in the api_key table of the main database, so several instances can share them
+type sqliteKeyStore struct {
+	db *sql.DB
+}
+
+func newSqliteKeyStore(db *sql.DB) (*sqliteKeyStore, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS api_key (
+		id TEXT PRIMARY KEY,
+		hash TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		owner TEXT NOT NULL DEFAULT '',
+		level TEXT NOT NULL,
+		scopes TEXT NOT NULL DEFAULT '',
+		createdAt TEXT NOT NULL,
+		lastUsed TEXT,
+		expiresAt TEXT,
+		rateLimit TEXT,
+		signingSecret TEXT NOT NULL DEFAULT '',
+		sfwOnly INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	// Scopes are space separated, empty when the key uses the scopes of its level
+	err = ensureColumn(db, "api_key", "scopes", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+	err = ensureColumn(db, "api_key", "expiresAt", "TEXT")
+	if err != nil {
+		return nil, err
+	}
+	// JSON encoded RateLimit, null when the key uses the limits of its level
+	err = ensureColumn(db, "api_key", "rateLimit", "TEXT")
+	if err != nil {
+		return nil, err
+	}
+	err = ensureColumn(db, "api_key", "signingSecret", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return nil, err
+	}
+	err = ensureColumn(db, "api_key", "sfwOnly", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS signature_nonce (
+		nonce TEXT PRIMARY KEY,
+		expiresAt TEXT NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteKeyStore{db: db}, nil
+}
+
+const apiKeyColumns = "id, hash, prefix, label, owner, level, scopes, createdAt, lastUsed, expiresAt, rateLimit, signingSecret, sfwOnly"
+
+func scanApiKey(rows interface{ Scan(...interface{}) error }) (*ApiKeyRecord, error) {
+	var record ApiKeyRecord
+	var scopes, createdAt string
+	var lastUsed, expiresAt, rateLimit sql.NullString
+	err := rows.Scan(&record.Id, &record.Hash, &record.Prefix, &record.Label, &record.Owner, &record.Level, &scopes, &createdAt, &lastUsed, &expiresAt, &rateLimit, &record.SigningSecret, &record.SfwOnly)
+	if err != nil {
+		return nil, err
+	}
+	record.Scopes = strings.Fields(scopes)
+	record.CreatedAt, err = time.Parse(dbTimeLayout, createdAt)
+	if err != nil {
+		return nil, err
+	}
+	record.LastUsed, err = parseNullTime(lastUsed)
+	if err != nil {
+		return nil, err
+	}
+	record.ExpiresAt, err = parseNullTime(expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimit.Valid {
+		err = json.Unmarshal([]byte(rateLimit.String), &record.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+func parseNullTime(s sql.NullString) (*time.Time, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+	t, err := time.Parse(dbTimeLayout, s.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func formatNullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.UTC().Format(dbTimeLayout), Valid: true}
+}
+
+func (s *sqliteKeyStore) Lookup(rawKey string) (*ApiKeyRecord, error) {
+	row := s.db.QueryRow("SELECT "+apiKeyColumns+" FROM api_key WHERE api_key.hash = ?", hashApiKey(rawKey))
+	record, err := scanApiKey(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return record, err
+}
+
+func (s *sqliteKeyStore) Add(record ApiKeyRecord) error {
+	var rateLimit sql.NullString
+	if record.RateLimit != nil {
+		raw, err := json.Marshal(record.RateLimit)
+		if err != nil {
+			return err
+		}
+		rateLimit = sql.NullString{String: string(raw), Valid: true}
+	}
+	_, err := s.db.Exec("INSERT INTO api_key ("+apiKeyColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		record.Id, record.Hash, record.Prefix, record.Label, record.Owner, record.Level, strings.Join(record.Scopes, " "),
+		record.CreatedAt.UTC().Format(dbTimeLayout), formatNullTime(record.LastUsed), formatNullTime(record.ExpiresAt), rateLimit, record.SigningSecret, record.SfwOnly)
+	return err
+}
+
+func (s *sqliteKeyStore) Revoke(id string) (bool, error) {
+	res, err := s.db.Exec("DELETE FROM api_key WHERE api_key.id = ? OR api_key.hash = ?", id, hashApiKey(id))
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *sqliteKeyStore) List() ([]ApiKeyRecord, error) {
+	rows, err := s.db.Query("SELECT " + apiKeyColumns + " FROM api_key ORDER BY api_key.createdAt")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []ApiKeyRecord{}
+	for rows.Next() {
+		record, err := scanApiKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *record)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqliteKeyStore) Get(id string) (*ApiKeyRecord, error) {
+	row := s.db.QueryRow("SELECT "+apiKeyColumns+" FROM api_key WHERE api_key.id = ?", id)
+	record, err := scanApiKey(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return record, err
+}
+
+func (s *sqliteKeyStore) SetExpiry(id string, expiresAt *time.Time) (bool, error) {
+	res, err := s.db.Exec("UPDATE api_key SET expiresAt = ? WHERE api_key.id = ?", formatNullTime(expiresAt), id)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *sqliteKeyStore) Touch(id string, at time.Time) error {
+	threshold := at.Add(-lastUsedResolution)
+	_, err := s.db.Exec("UPDATE api_key SET lastUsed = ? WHERE api_key.id = ? AND (api_key.lastUsed IS NULL OR api_key.lastUsed < ?)",
+		formatNullTime(&at), id, formatNullTime(&threshold))
+	return err
+}
+
+func (s *sqliteKeyStore) UseNonce(nonce string, expires time.Time) (bool, error) {
+	now := time.Now()
+	_, err := s.db.Exec("DELETE FROM signature_nonce WHERE signature_nonce.expiresAt <= ?", formatNullTime(&now))
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec("INSERT OR IGNORE INTO signature_nonce (nonce, expiresAt) VALUES (?, ?)", nonce, formatNullTime(&expires))
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return inserted == 1, nil
+}
+
+func (s *sqliteKeyStore) Reload() error {
+	// Every lookup already reads the table
+	return nil
+}
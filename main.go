@@ -1,42 +1,111 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/tkanos/gonfig"
 )
 
 var master_key string = ""
-var generic_keys []string = []string{}
-var write_keys []string = []string{}
+var config ConfigFile
+
+// Used when neither the config nor the request give a rotation grace period
+const defaultKeyRotationGrace = 24 * time.Hour
+
+// Most games a single search page can return
+const maxSearchLimit = 1000
+
+// Elasticsearch's index.max_result_window, the furthest page-numbered results can reach
+const maxSearchWindow = 10000
+
+const defaultSuggestLimit = 10
+const maxSuggestLimit = 50
+
+const maxRandomCount = 50
+
+const defaultRelatedLimit = 10
+const maxRelatedLimit = 50
 
 type ConfigFile struct {
-	Port   string `json:"Port"`
-	EsUri  string `json:"EsUri"`
-	DbPath string `json:"DbPath"`
+	Port     string `json:"Port"`
+	EsUri    string `json:"EsUri"`
+	DbPath   string `json:"DbPath"`
+	KeyStore string `json:"KeyStore"`
+	// How long a rotated key keeps working, as a duration string e.g. "24h"
+	KeyRotationGrace string `json:"KeyRotationGrace"`
+	// Limits by key level, with "default" used for levels not listed
+	RateLimits map[string]RateLimit `json:"RateLimits"`
+	Anonymous  AnonymousConfig      `json:"Anonymous"`
+	// Require every stored key to sign requests to write routes, not only keys made with a signing secret
+	RequireSignedWrites bool `json:"RequireSignedWrites"`
+	// How far a signature timestamp may be from the server clock, as a duration string e.g. "5m"
+	SignatureMaxSkew string `json:"SignatureMaxSkew"`
+	// Accept JWTs signed by keys in a local JWKS file, unset to only accept stored keys
+	Jwt *JwtConfig `json:"Jwt"`
+	// Where games are indexed and searched, one of ("elasticsearch", "sqlite").
+	// "sqlite" needs FTS5, which go-sqlite3 only builds in with 'go build -tags sqlite_fts5'.
+	SearchBackend string `json:"SearchBackend"`
+	// Named field boosts and scoring picked by GameSearch.Profile, with "default" used when none is given
+	SearchProfiles map[string]SearchProfile `json:"SearchProfiles"`
 }
 
 type ApiResult struct {
 	Message string      `json:"message"`
 	Result  interface{} `json:"result,omitempty"`
+	// Set when the result came from a fallback because the search backend is down
+	Degraded bool `json:"degraded,omitempty"`
 }
 
 type GameSearch struct {
-	Query   string `json:"query"`
+	Query string `json:"query"`
+	// How the query is read, one of ("simple", "phrase", "lucene")
+	Mode string `json:"mode,omitempty"`
+	// Name of the relevance profile from the config to score results with
+	Profile string `json:"profile,omitempty"`
 	Fuzz    int    `json:"fuzz,omitempty"`
 	Extreme bool   `json:"extreme,omitempty"`
 	Page    int    `json:"page"`
 	Limit   int    `json:"limit,omitempty"`
 	Sort    string `json:"sort,omitempty"`
 	Order   string `json:"order,omitempty"`
+	// Filters, each matching games with any of the values given
+	Platform  []string `json:"platform,omitempty"`
+	PlayMode  []string `json:"playMode,omitempty"`
+	Status    []string `json:"status,omitempty"`
+	Language  []string `json:"language,omitempty"`
+	Library   []string `json:"library,omitempty"`
+	Developer []string `json:"developer,omitempty"`
+	Publisher []string `json:"publisher,omitempty"`
+	Series    []string `json:"series,omitempty"`
+	// Games must have every included tag and none of the excluded ones
+	IncludeTags []string   `json:"includeTags,omitempty"`
+	ExcludeTags []string   `json:"excludeTags,omitempty"`
+	DateAdded   *DateRange `json:"dateAdded,omitempty"`
+	ReleaseDate *DateRange `json:"releaseDate,omitempty"`
+	// Names of the facets to count values of across all matching games
+	Facets []string `json:"facets,omitempty"`
+	// Adds snippets of where the query matched to each game, wrapped in the tags given
+	Highlight        bool   `json:"highlight,omitempty"`
+	HighlightPreTag  string `json:"highlightPreTag,omitempty"`
+	HighlightPostTag string `json:"highlightPostTag,omitempty"`
+	// Pages through a snapshot of the results instead of by page number.
+	// Empty to start, then the cursor from the previous response.
+	Cursor *string `json:"cursor,omitempty"`
+	// Every alias of the included and excluded tags, filled in by resolveTagAliases
+	tagAliases map[string][]string
 }
 
 func homePage(w http.ResponseWriter, r *http.Request) {
@@ -50,6 +119,16 @@ func sendCustomApiResult(w http.ResponseWriter, status int, response interface{}
 	json.NewEncoder(w).Encode(response)
 }
 
+// Writes the response for an error from the search backend
+func sendSearchError(w http.ResponseWriter, err error) {
+	if searchErr, ok := err.(*SearchRequestError); ok {
+		sendApiResult(w, searchErr.status, searchErr.message, nil)
+		return
+	}
+	log.Println(err)
+	sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+}
+
 func sendApiResult(w http.ResponseWriter, status int, message string, result interface{}) {
 	apiResult := ApiResult{
 		Message: message,
@@ -60,299 +139,639 @@ func sendApiResult(w http.ResponseWriter, status int, message string, result int
 	json.NewEncoder(w).Encode(apiResult)
 }
 
-func searchApi(w http.ResponseWriter, r *http.Request) {
-	searchStruct := GameSearch{
-		Fuzz:    0,
-		Extreme: true,
-		Page:    1,
-		Limit:   50,
-		Sort:    "title",
-		Order:   "asc",
-	}
-	if r.Body != nil {
+// Reads the search from the request body and applies the limits of the caller's key.
+// Writes the error response and returns false if the search isn't valid.
+func parseGameSearch(w http.ResponseWriter, r *http.Request, searchStruct *GameSearch) bool {
+	if r.Body != nil && r.Body != http.NoBody {
 		if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
 			dec := json.NewDecoder(r.Body)
 			dec.DisallowUnknownFields()
-			err := dec.Decode(&searchStruct)
+			err := dec.Decode(searchStruct)
 			if err != nil {
 				sendApiResult(w, http.StatusBadRequest, "Unable to parse body", err)
-				return
+				return false
 			}
 		} else {
 			sendApiResult(w, http.StatusBadRequest, "Body must be JSON", nil)
-			return
+			return false
 		}
 	}
-	games, total, err := search(&searchStruct)
+	err := validateGameSearch(searchStruct)
 	if err != nil {
-		log.Println(err)
+		sendApiResult(w, http.StatusBadRequest, err.Error(), nil)
+		return false
+	}
+	if requestApiKey(r).isAnonymous() {
+		// Each new walk holds a point in time open on the cluster
+		if searchStruct.Cursor != nil {
+			sendApiResult(w, http.StatusForbidden, "Cursor paging needs an API key", nil)
+			return false
+		}
+		maxLimit := currentConfig().Anonymous.maxLimit()
+		if searchStruct.Limit > maxLimit {
+			searchStruct.Limit = maxLimit
+		}
+	}
+	if requestApiKey(r).SfwOnly {
+		searchStruct.Extreme = false
+	}
+	dbErr := resolveTagAliases(searchStruct)
+	if dbErr != nil {
+		log.Println(dbErr.err)
 		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+		return false
+	}
+	return true
+}
+
+func searchApi(w http.ResponseWriter, r *http.Request) {
+	searchStruct := GameSearch{
+		Fuzz:             0,
+		Mode:             QueryModeSimple,
+		Extreme:          false,
+		Page:             1,
+		Limit:            50,
+		Sort:             "title",
+		Order:            "asc",
+		HighlightPreTag:  "<em>",
+		HighlightPostTag: "</em>",
+	}
+	if !parseGameSearch(w, r, &searchStruct) {
 		return
 	}
-	if len(games) == 0 {
-		sendCustomApiResult(w, http.StatusOK, map[string]interface{}{
+	result, err := searchBackend.Search(&searchStruct)
+	if err != nil {
+		sendSearchError(w, err)
+		return
+	}
+	if len(result.Games) == 0 {
+		res := map[string]interface{}{
 			"message":   "No Games Found",
 			"last_page": 1,
 			"result":    []interface{}{},
-		})
+		}
+		if result.Facets != nil {
+			res["facets"] = result.Facets
+		}
+		if result.Degraded {
+			res["degraded"] = true
+		}
+		sendCustomApiResult(w, http.StatusOK, res)
 		return
 	}
-	sendCustomApiResult(w, http.StatusOK, map[string]interface{}{
-		"message":   fmt.Sprintf("Found %d Games", int(total)),
-		"last_page": int(math.Ceil(total / float64(searchStruct.Limit))),
-		"result":    games,
-		"total":     int(total),
-	})
+	res := map[string]interface{}{
+		"message":   fmt.Sprintf("Found %d Games", int(result.Total)),
+		"last_page": int(math.Ceil(result.Total / float64(searchStruct.Limit))),
+		"result":    result.Games,
+		"total":     int(result.Total),
+	}
+	if result.Facets != nil {
+		res["facets"] = result.Facets
+	}
+	if result.Cursor != "" {
+		res["cursor"] = result.Cursor
+	}
+	if result.Degraded {
+		res["degraded"] = true
+	}
+	sendCustomApiResult(w, http.StatusOK, res)
 }
 
-func findGameById(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	game_id := vars["id"]
-	game, err := _findGameById(game_id)
-	if err != nil {
-		log.Println(err)
-		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+func suggestApi(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := strings.TrimSpace(query.Get("q"))
+	if prefix == "" {
+		sendApiResult(w, http.StatusBadRequest, "'q' param is required", nil)
 		return
 	}
-	if game == nil {
-		sendApiResult(w, http.StatusNotFound, "Not Found", nil)
+	limit := defaultSuggestLimit
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxSuggestLimit {
+			sendApiResult(w, http.StatusBadRequest, fmt.Sprintf("'limit' param must be between 1 and %d", maxSuggestLimit), nil)
+			return
+		}
+	}
+	if requestApiKey(r).isAnonymous() && limit > currentConfig().Anonymous.maxLimit() {
+		limit = currentConfig().Anonymous.maxLimit()
+	}
+	suggester, ok := searchBackend.(GameSuggester)
+	if !ok {
+		sendApiResult(w, http.StatusNotImplemented, "Not supported by the search backend", nil)
+		return
+	}
+	extreme := query.Get("extreme") == "true" && !requestApiKey(r).SfwOnly
+	suggestions, err := suggester.SuggestGames(prefix, extreme, limit)
+	if err != nil {
+		sendSearchError(w, err)
 		return
 	}
-	sendApiResult(w, http.StatusOK, "Found Game", game)
+	sendApiResult(w, http.StatusOK, fmt.Sprintf("Found %d Suggestions", len(suggestions)), suggestions)
 }
 
-func masterAuth(cb func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") {
-			sendApiResult(w, http.StatusBadRequest, "Invalid Authorization Header", nil)
+func randomGamesApi(w http.ResponseWriter, r *http.Request) {
+	picker, ok := searchBackend.(RandomGamePicker)
+	if !ok {
+		sendApiResult(w, http.StatusNotImplemented, "Not supported by the search backend", nil)
+		return
+	}
+	// Only the query and filters of the search apply, paging and sorting are ignored
+	searchStruct := GameSearch{
+		Mode:  QueryModeSimple,
+		Page:  1,
+		Limit: maxRandomCount,
+		Sort:  "title",
+		Order: "asc",
+	}
+	if !parseGameSearch(w, r, &searchStruct) {
+		return
+	}
+	query := r.URL.Query()
+	count := 1
+	if query.Get("count") != "" {
+		var err error
+		count, err = strconv.Atoi(query.Get("count"))
+		if err != nil || count < 1 || count > maxRandomCount {
+			sendApiResult(w, http.StatusBadRequest, fmt.Sprintf("'count' param must be between 1 and %d", maxRandomCount), nil)
 			return
 		}
-		auth_key := auth[len("Bearer "):]
-		if auth_key == master_key {
-			cb(w, r)
+	}
+	if requestApiKey(r).isAnonymous() && count > currentConfig().Anonymous.maxLimit() {
+		count = currentConfig().Anonymous.maxLimit()
+	}
+	games, err := picker.RandomGames(&searchStruct, count, query.Get("seed"))
+	if err != nil {
+		sendSearchError(w, err)
+		return
+	}
+	if len(games) == 0 {
+		sendApiResult(w, http.StatusOK, "No Games Found", []interface{}{})
+		return
+	}
+	sendApiResult(w, http.StatusOK, fmt.Sprintf("Found %d Games", len(games)), games)
+}
+
+func relatedGamesApi(w http.ResponseWriter, r *http.Request) {
+	finder, ok := searchBackend.(RelatedGameFinder)
+	if !ok {
+		sendApiResult(w, http.StatusNotImplemented, "Not supported by the search backend", nil)
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultRelatedLimit
+	if query.Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxRelatedLimit {
+			sendApiResult(w, http.StatusBadRequest, fmt.Sprintf("'limit' param must be between 1 and %d", maxRelatedLimit), nil)
 			return
 		}
-		sendApiResult(w, http.StatusForbidden, "Forbidden", nil)
 	}
+	if requestApiKey(r).isAnonymous() && limit > currentConfig().Anonymous.maxLimit() {
+		limit = currentConfig().Anonymous.maxLimit()
+	}
+	extreme := query.Get("extreme") == "true" && !requestApiKey(r).SfwOnly
+	game, err := searchBackend.FindGameById(mux.Vars(r)["id"])
+	if err != nil {
+		log.Println(err)
+		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+		return
+	}
+	if game == nil || (game.Extreme && !extreme) {
+		sendApiResult(w, http.StatusNotFound, "Not Found", nil)
+		return
+	}
+	var platforms []string
+	for _, platform := range query["platform"] {
+		for _, value := range strings.Split(platform, ",") {
+			if strings.TrimSpace(value) != "" {
+				platforms = append(platforms, strings.TrimSpace(value))
+			}
+		}
+	}
+	games, err := finder.RelatedGames(game, &GameSearch{Extreme: extreme, Platform: platforms}, limit)
+	if err != nil {
+		sendSearchError(w, err)
+		return
+	}
+	sendApiResult(w, http.StatusOK, fmt.Sprintf("Found %d Related Games", len(games)), games)
 }
 
-func indexKey(auth_key string, arr []string) int {
-	for i := 0; i < len(arr); i++ {
-		if auth_key == arr[i] {
-			return i
-		}
+func findGameById(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	game_id := vars["id"]
+	game, degraded, err := lookupGame(game_id)
+	if err != nil {
+		log.Println(err)
+		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+		return
 	}
-	return -1
+	// Extreme games are hidden unless asked for, as if they didn't exist
+	if game != nil && game.Extreme && (r.URL.Query().Get("extreme") != "true" || requestApiKey(r).SfwOnly) {
+		game = nil
+	}
+	if game == nil {
+		sendCustomApiResult(w, http.StatusNotFound, ApiResult{Message: "Not Found", Degraded: degraded})
+		return
+	}
+	sendCustomApiResult(w, http.StatusOK, ApiResult{Message: "Found Game", Result: game, Degraded: degraded})
 }
 
-func writeAuth(cb func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") {
-			sendApiResult(w, http.StatusBadRequest, "Invalid Authorization Header", nil)
-			return
+type apiKeyContextKey struct{}
+
+// Returns the key which authorized the request
+func requestApiKey(r *http.Request) *ApiKeyRecord {
+	record, _ := r.Context().Value(apiKeyContextKey{}).(*ApiKeyRecord)
+	return record
+}
+
+// Checks the bearer key against the master key, then as a JWT or against the key store for the given scope.
+// An empty scope only admits the master key and master level tokens.
+func checkAuth(w http.ResponseWriter, r *http.Request, scope string) *ApiKeyRecord {
+	auth := r.Header.Get("Authorization")
+	if auth == "" && scope != "" {
+		record, handled := checkAnonymousAuth(w, r, scope)
+		if handled {
+			return record
 		}
-		auth_key := auth[len("Bearer "):]
-		if auth_key == master_key {
-			cb(w, r)
-			return
+	}
+	if !strings.HasPrefix(auth, "Bearer ") {
+		sendApiResult(w, http.StatusBadRequest, "Invalid Authorization Header", nil)
+		return nil
+	}
+	auth_key := auth[len("Bearer "):]
+	if subtle.ConstantTimeCompare([]byte(auth_key), []byte(currentMasterKey())) == 1 {
+		return &masterKeyRecord
+	}
+	var record *ApiKeyRecord
+	var err error
+	// Stored keys have usage to record and may need to sign writes, tokens carry everything themselves
+	stored := false
+	if currentConfig().Jwt != nil && looksLikeJwt(auth_key) {
+		record, err = verifyJwt(auth_key)
+		if err != nil {
+			sendApiResult(w, http.StatusUnauthorized, err.Error(), nil)
+			return nil
 		}
-		if indexKey(auth_key, write_keys) != -1 {
-			cb(w, r)
-			return
+	} else {
+		record, err = keyStore.Lookup(auth_key)
+		if err != nil {
+			log.Println(err)
+			sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+			return nil
 		}
+		stored = true
+	}
+	if record != nil && record.isExpired(time.Now()) {
+		sendApiResult(w, http.StatusUnauthorized, "API Key Expired", nil)
+		return nil
+	}
+	if record == nil || (scope == "" && record.Level != "master") || (scope != "" && !record.hasScope(scope)) {
 		sendApiResult(w, http.StatusForbidden, "Forbidden", nil)
+		return nil
 	}
-}
-
-func generalAuth(cb func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") {
-			sendApiResult(w, http.StatusBadRequest, "Invalid Authorization Header", nil)
-			return
+	// Checked first so requests that aren't really from the key don't use up its limits
+	if stored && isWriteScope(scope) && (record.SigningSecret != "" || currentConfig().RequireSignedWrites) {
+		err = verifySignature(r, record)
+		if err == errNonceCheckFailed {
+			sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+			return nil
 		}
-		auth_key := auth[len("Bearer "):]
-		if auth_key == master_key {
-			cb(w, r)
-			return
+		if err != nil {
+			sendApiResult(w, http.StatusUnauthorized, err.Error(), nil)
+			return nil
 		}
-		if indexKey(auth_key, write_keys) != -1 {
-			cb(w, r)
-			return
+	}
+	if !enforceRateLimit(w, record.Id, rateLimitFor(record)) {
+		return nil
+	}
+	if stored {
+		err = keyStore.Touch(record.Id, time.Now().UTC())
+		if err != nil {
+			log.Printf("Error saving key usage: %v", err)
 		}
-		if indexKey(auth_key, generic_keys) != -1 {
-			cb(w, r)
-			return
+	}
+	return record
+}
+
+func masterAuth(cb func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return scopeAuth("", cb)
+}
+
+// Only admits keys holding the given scope
+func scopeAuth(scope string, cb func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		record := checkAuth(w, r, scope)
+		if record != nil {
+			cb(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, record)))
 		}
-		sendApiResult(w, http.StatusForbidden, "Forbidden", nil)
 	}
 }
 
 func listApiKeys(w http.ResponseWriter, r *http.Request) {
-	var keys = map[string][]string{}
-	keys["generic"] = generic_keys
-	keys["write"] = write_keys
+	records, err := keyStore.List()
+	if err != nil {
+		log.Println(err)
+		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+		return
+	}
+	var keys = []Api_KeyModel{}
+	for _, record := range records {
+		keys = append(keys, record.toApiModel())
+	}
 	sendApiResult(w, http.StatusOK, "Success", keys)
 }
 
-func loadConfig() ConfigFile {
+func loadConfig() (ConfigFile, error) {
 	configuration := ConfigFile{}
 	fileName := "./config.json"
-	gonfig.GetConf(fileName, &configuration)
-	return configuration
+	err := gonfig.GetConf(fileName, &configuration)
+	if err != nil {
+		return configuration, err
+	}
+	return configuration, validateSearchProfiles(configuration.SearchProfiles)
 }
 
-func loadWriteKeys() error {
-	raw_keys, err := os.ReadFile("./write_keys")
+func reloadApi(w http.ResponseWriter, r *http.Request) {
+	err := reloadSettings()
 	if err != nil {
-		_, err = os.Create("./write_keys")
-		if err != nil {
-			return err
-		}
-		write_keys = []string{}
-	} else {
-		unclean_keys := strings.Split(string(raw_keys), "\n")
-		write_keys = []string{}
-		for i := 0; i < len(unclean_keys); i++ {
-			clean_key := strings.TrimSpace(unclean_keys[i])
-			if clean_key != "" {
-				write_keys = append(write_keys, clean_key)
-			}
-		}
+		log.Printf("Error reloading settings, keeping previous settings: %v", err)
+		sendApiResult(w, http.StatusInternalServerError, "Reload Failed, previous settings kept", err.Error())
+		return
 	}
-	return nil
+	sendApiResult(w, http.StatusOK, "Settings Reloaded", nil)
 }
 
-func loadGenericKeys() error {
-	raw_keys, err := os.ReadFile("./generic_keys")
+// Only one reindex runs at a time, as Elasticsearch reindexes by dropping the index
+var reindexMu sync.Mutex
+
+func reindexApi(w http.ResponseWriter, r *http.Request) {
+	reindexMu.Lock()
+	defer reindexMu.Unlock()
+	count, err := populateEs()
 	if err != nil {
-		_, err = os.Create("./generic_keys")
-		if err != nil {
-			return err
-		}
-		generic_keys = []string{}
-	} else {
-		unclean_keys := strings.Split(string(raw_keys), "\n")
-		generic_keys = []string{}
-		for i := 0; i < len(unclean_keys); i++ {
-			clean_key := strings.TrimSpace(unclean_keys[i])
-			if clean_key != "" {
-				generic_keys = append(generic_keys, clean_key)
-			}
-		}
+		log.Printf("Error reindexing games: %v", err)
+		sendApiResult(w, http.StatusInternalServerError, "Reindex Failed", nil)
+		return
 	}
-	return nil
+	sendApiResult(w, http.StatusOK, fmt.Sprintf("Indexed %d Games", count), nil)
 }
 
 func deleteApiKey(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	api_key := vars["id"]
-	key_idx := indexKey(api_key, generic_keys)
-	if key_idx == -1 {
-		key_idx := indexKey(api_key, write_keys)
-		if key_idx == -1 {
-			write_keys = append(write_keys[:key_idx], write_keys[key_idx+1:]...)
-			saveWriteKeys()
-			sendApiResult(w, http.StatusOK, "Deleted", nil)
-		} else {
-			sendApiResult(w, http.StatusNotFound, "Not Found", nil)
+	target, err := keyStore.Get(api_key)
+	if err == nil && target == nil {
+		target, err = keyStore.Lookup(api_key)
+	}
+	if err != nil {
+		log.Println(err)
+		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+		return
+	}
+	if target == nil {
+		sendApiResult(w, http.StatusNotFound, "Not Found", nil)
+		return
+	}
+	// Keys can only revoke keys with no more access than they have themselves
+	caller := requestApiKey(r)
+	for _, scope := range target.effectiveScopes() {
+		if !caller.hasScope(scope) {
+			sendApiResult(w, http.StatusForbidden, fmt.Sprintf("Cannot revoke a key with scope '%s'", scope), nil)
 			return
 		}
 	}
-	generic_keys = append(generic_keys[:key_idx], generic_keys[key_idx+1:]...)
-	saveGenericKeys()
+	removed, err := keyStore.Revoke(target.Id)
+	if err != nil {
+		log.Println(err)
+		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+		return
+	}
+	if !removed {
+		sendApiResult(w, http.StatusNotFound, "Not Found", nil)
+		return
+	}
 	sendApiResult(w, http.StatusOK, "Deleted", nil)
 }
 
 func genApiKey(w http.ResponseWriter, r *http.Request) {
-	new_key := uuid.New().String()
-	level_raw := r.URL.Query()["level"]
-	present := len(level_raw) > 0
+	query := r.URL.Query()
 	level := "generic"
-	if present {
-		level = level_raw[0]
-		if level == "write" {
-			write_keys = append(write_keys, new_key)
-			saveWriteKeys()
-		} else if level == "generic" {
-			generic_keys = append(generic_keys, new_key)
-			saveGenericKeys()
-		} else {
+	var scopes []string
+	if query.Get("scopes") != "" {
+		level = "custom"
+		for _, scope := range strings.Split(query.Get("scopes"), ",") {
+			scope = strings.TrimSpace(scope)
+			if !isKnownScope(scope) {
+				sendApiResult(w, http.StatusBadRequest, fmt.Sprintf("Unknown scope '%s', must be of ('%s')", scope, strings.Join(allScopes, "', '")), nil)
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+	} else if query.Get("level") != "" {
+		level = query.Get("level")
+		if level != "write" && level != "generic" {
 			sendApiResult(w, http.StatusBadRequest, "'level' param must be of ('write', 'generic')", nil)
 			return
 		}
-		sendApiResult(w, http.StatusOK, fmt.Sprintf("New Key with '%s' auth level", level), new_key)
+	}
+	// Keys can't hand out more access than they have themselves
+	caller := requestApiKey(r)
+	requested := scopes
+	if len(requested) == 0 {
+		requested = levelScopes[level]
+	}
+	for _, scope := range requested {
+		if !caller.hasScope(scope) {
+			sendApiResult(w, http.StatusForbidden, fmt.Sprintf("Cannot grant scope '%s'", scope), nil)
+			return
+		}
+	}
+	expiresAt, err := parseKeyExpiry(query)
+	if err != nil {
+		sendApiResult(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	rateLimit, err := parseKeyRateLimit(query)
+	if err != nil {
+		sendApiResult(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	new_key, record, err := createApiKey(ApiKeyRecord{
+		Level:     level,
+		Scopes:    scopes,
+		Label:     query.Get("label"),
+		Owner:     query.Get("owner"),
+		ExpiresAt: expiresAt,
+		RateLimit: rateLimit,
+		SfwOnly:   query.Get("sfw") == "true",
+	}, query.Get("signed") == "true")
+	if err != nil {
+		log.Println(err)
+		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
 		return
 	}
-	generic_keys = append(generic_keys, new_key)
-	saveGenericKeys()
-	sendApiResult(w, http.StatusOK, fmt.Sprintf("New Key with '%s' auth level", level), new_key)
+	// Only time the full key and signing secret are ever shown
+	res := record.toApiModel()
+	res.Key = &new_key
+	if record.SigningSecret != "" {
+		res.SigningSecret = &record.SigningSecret
+	}
+	sendApiResult(w, http.StatusOK, fmt.Sprintf("New Key with '%s' auth level", level), res)
 }
 
-func saveWriteKeys() error {
-	var content string = ""
-	for i := 0; i < len(write_keys); i++ {
-		content = content + "\n" + write_keys[i]
+// Reads an optional expiry from either 'expires_in' (e.g. "720h") or 'expires_at' (RFC3339)
+func parseKeyExpiry(query url.Values) (*time.Time, error) {
+	if query.Get("expires_in") != "" {
+		duration, err := time.ParseDuration(query.Get("expires_in"))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("'expires_in' param must be a positive duration such as '720h'")
+		}
+		expiresAt := time.Now().UTC().Add(duration)
+		return &expiresAt, nil
+	}
+	if query.Get("expires_at") != "" {
+		expiresAt, err := time.Parse(time.RFC3339, query.Get("expires_at"))
+		if err != nil || !expiresAt.After(time.Now()) {
+			return nil, fmt.Errorf("'expires_at' param must be a future RFC3339 time")
+		}
+		expiresAt = expiresAt.UTC()
+		return &expiresAt, nil
 	}
-	return os.WriteFile("./write_keys", []byte(content), 0644)
+	return nil, nil
 }
 
-func saveGenericKeys() error {
-	var content string = ""
-	for i := 0; i < len(generic_keys); i++ {
-		content = content + "\n" + generic_keys[i]
+// Reads optional per key limits from 'rate', 'burst' and 'daily_quota'
+func parseKeyRateLimit(query url.Values) (*RateLimit, error) {
+	if query.Get("rate") == "" && query.Get("burst") == "" && query.Get("daily_quota") == "" {
+		return nil, nil
+	}
+	var limit RateLimit
+	var err error
+	if query.Get("rate") != "" {
+		limit.Rate, err = strconv.ParseFloat(query.Get("rate"), 64)
+		if err != nil || limit.Rate < 0 {
+			return nil, fmt.Errorf("'rate' param must be a non-negative number of requests per second")
+		}
+	}
+	if query.Get("burst") != "" {
+		limit.Burst, err = strconv.Atoi(query.Get("burst"))
+		if err != nil || limit.Burst < 0 {
+			return nil, fmt.Errorf("'burst' param must be a non-negative integer")
+		}
+	}
+	if query.Get("daily_quota") != "" {
+		limit.DailyQuota, err = strconv.Atoi(query.Get("daily_quota"))
+		if err != nil || limit.DailyQuota < 0 {
+			return nil, fmt.Errorf("'daily_quota' param must be a non-negative integer")
+		}
 	}
-	return os.WriteFile("./generic_keys", []byte(content), 0644)
+	return &limit, nil
+}
+
+func rotateApiKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	old, err := keyStore.Get(vars["id"])
+	if err != nil {
+		log.Println(err)
+		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+		return
+	}
+	if old == nil {
+		sendApiResult(w, http.StatusNotFound, "Not Found", nil)
+		return
+	}
+	if old.isExpired(time.Now()) {
+		sendApiResult(w, http.StatusBadRequest, "Cannot rotate an expired key", nil)
+		return
+	}
+	caller := requestApiKey(r)
+	for _, scope := range old.effectiveScopes() {
+		if !caller.hasScope(scope) {
+			sendApiResult(w, http.StatusForbidden, fmt.Sprintf("Cannot grant scope '%s'", scope), nil)
+			return
+		}
+	}
+	grace := defaultKeyRotationGrace
+	if currentConfig().KeyRotationGrace != "" {
+		grace, err = time.ParseDuration(currentConfig().KeyRotationGrace)
+		if err != nil {
+			log.Printf("Invalid KeyRotationGrace: %v", err)
+			grace = defaultKeyRotationGrace
+		}
+	}
+	if query.Get("grace") != "" {
+		grace, err = time.ParseDuration(query.Get("grace"))
+		if err != nil || grace < 0 {
+			sendApiResult(w, http.StatusBadRequest, "'grace' param must be a duration such as '24h'", nil)
+			return
+		}
+	}
+	expiresAt, err := parseKeyExpiry(query)
+	if err != nil {
+		sendApiResult(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	new_key, record, err := createRotatedApiKey(*old, grace, expiresAt)
+	if err != nil {
+		log.Println(err)
+		sendApiResult(w, http.StatusInternalServerError, "Server Error", nil)
+		return
+	}
+	res := record.toApiModel()
+	res.Key = &new_key
+	if record.SigningSecret != "" {
+		res.SigningSecret = &record.SigningSecret
+	}
+	sendApiResult(w, http.StatusOK, fmt.Sprintf("Rotated Key, old key valid for %s", grace), res)
 }
 
 func handleRequests(port string) {
 	router := mux.NewRouter()
 	router.HandleFunc("/", homePage)
-	router.HandleFunc("/api/games", generalAuth(searchApi)).Methods("GET")
-	router.HandleFunc("/api/game/{id}", generalAuth(findGameById)).Methods("GET")
-	router.HandleFunc("/api/keys", masterAuth(listApiKeys)).Methods("GET")
-	router.HandleFunc("/api/key/{id}", masterAuth(deleteApiKey)).Methods("DELETE")
-	router.HandleFunc("/api/key", masterAuth(genApiKey)).Methods("POST")
-	router.HandleFunc("/api/tag/{id}", generalAuth(apiTagGet)).Methods("GET")
-	router.HandleFunc("/api/tag/{id}", writeAuth(apiTagPost)).Methods("POST", "PUT", "PATCH")
-	router.HandleFunc("/api/tag", writeAuth(apiTagNewPost)).Methods("POST")
-	router.HandleFunc("/api/tags", generalAuth(apiTagsGet)).Methods("GET")
-	router.HandleFunc("/api/categories", generalAuth(apiCategoriesGet)).Methods("GET")
+	router.HandleFunc("/api/games", scopeAuth(ScopeGamesRead, searchApi)).Methods("GET")
+	router.HandleFunc("/api/games/suggest", scopeAuth(ScopeGamesRead, suggestApi)).Methods("GET")
+	router.HandleFunc("/api/games/random", scopeAuth(ScopeGamesRead, randomGamesApi)).Methods("GET")
+	router.HandleFunc("/api/game/{id}", scopeAuth(ScopeGamesRead, findGameById)).Methods("GET")
+	router.HandleFunc("/api/game/{id}/related", scopeAuth(ScopeGamesRead, relatedGamesApi)).Methods("GET")
+	router.HandleFunc("/api/keys", scopeAuth(ScopeKeysAdmin, listApiKeys)).Methods("GET")
+	router.HandleFunc("/api/key/{id}", scopeAuth(ScopeKeysAdmin, deleteApiKey)).Methods("DELETE")
+	router.HandleFunc("/api/key/{id}/rotate", scopeAuth(ScopeKeysAdmin, rotateApiKey)).Methods("POST")
+	router.HandleFunc("/api/key", scopeAuth(ScopeKeysAdmin, genApiKey)).Methods("POST")
+	router.HandleFunc("/api/tag/{id}", scopeAuth(ScopeTagsRead, apiTagGet)).Methods("GET")
+	router.HandleFunc("/api/tag/{id}", scopeAuth(ScopeTagsWrite, apiTagPost)).Methods("POST", "PUT", "PATCH")
+	router.HandleFunc("/api/tag", scopeAuth(ScopeTagsWrite, apiTagNewPost)).Methods("POST")
+	router.HandleFunc("/api/tags", scopeAuth(ScopeTagsRead, apiTagsGet)).Methods("GET")
+	router.HandleFunc("/api/admin/reload", masterAuth(reloadApi)).Methods("POST")
+	router.HandleFunc("/api/admin/reindex", masterAuth(reindexApi)).Methods("POST")
+	router.HandleFunc("/api/audit", masterAuth(apiAuditGet)).Methods("GET")
+	router.HandleFunc("/api/categories", scopeAuth(ScopeCategoriesRead, apiCategoriesGet)).Methods("GET")
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), router))
 }
 
 func main() {
-	raw_master_key, err := os.ReadFile("./master_key")
-	if err != nil {
+	_, err := os.Stat("./master_key")
+	if os.IsNotExist(err) {
 		_, err := os.Create("./master_key")
 		if err != nil {
 			log.Fatal(err)
 			return
 		}
-		log.Fatal("Please fill in the master_key file")
-	} else {
-		master_key = string(raw_master_key)
-		if master_key == "" {
-			log.Fatal("Please fill in the master_key file")
-		}
 	}
-	err = loadGenericKeys()
+	master_key, err = readMasterKey()
 	if err != nil {
-		log.Printf("Error loading generic keys: %v", err)
-		return
+		log.Fatal(err)
 	}
-	err = loadWriteKeys()
+	config, err = loadConfig()
 	if err != nil {
-		log.Printf("Error loading write keys: %v", err)
-		return
+		log.Fatalf("Error loading config: %v", err)
 	}
-	config := loadConfig()
 	log.Printf("%v", config)
-	err = esInit(config.EsUri)
+	err = loadJwks()
 	if err != nil {
-		log.Printf("esInit Error: %v", err)
+		log.Printf("Error loading JWKS: %v", err)
 		return
 	}
 	err = dbInit(config.DbPath)
@@ -360,6 +779,36 @@ func main() {
 		log.Printf("dbInit Error: %v", err)
 		return
 	}
+	searchBackend, err = openSearchBackend(config.SearchBackend)
+	if err != nil {
+		log.Printf("Error opening search backend: %v", err)
+		return
+	}
+	err = indexIfEmpty()
+	if err != nil {
+		log.Printf("Error indexing games: %v", err)
+		return
+	}
+	keyStore, err = openKeyStore(config.KeyStore)
+	if err != nil {
+		log.Printf("Error loading api keys: %v", err)
+		return
+	}
+	err = auditInit()
+	if err != nil {
+		log.Printf("auditInit Error: %v", err)
+		return
+	}
+	limiter, err = newRateLimiter(db)
+	if err != nil {
+		log.Printf("Error loading key usage: %v", err)
+		return
+	}
+	go limiter.run()
+	if failover, ok := searchBackend.(*failoverSearchBackend); ok {
+		go failover.run()
+	}
+	go watchSettings()
 	// count, err := populateEs()
 	// if err != nil {
 	// 	log.Printf("populateEs Error: %v", err)
@@ -367,5 +816,5 @@ func main() {
 	// }
 	// log.Printf("Total Games Loaded: %d", count)
 	log.Println("API Initialized!")
-	handleRequests(config.Port)
+	handleRequests(currentConfig().Port)
 }
@@ -5,3 +5,22 @@ type DbResultError struct {
 	message string
 	err     error
 }
+
+type UnknownBackendError struct {
+	kind string
+	name string
+}
+
+func (e *UnknownBackendError) Error() string {
+	return "Unknown " + e.kind + " backend '" + e.name + "'"
+}
+
+// A search the caller got wrong, as opposed to a failure of the search engine
+type SearchRequestError struct {
+	status  int
+	message string
+}
+
+func (e *SearchRequestError) Error() string {
+	return e.message
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type Api_TagModel struct {
 	PrimaryAlias *string   `json:"name,omitempty"`
 	Aliases      *[]string `json:"aliases,omitempty"`
@@ -12,3 +14,40 @@ type Api_TagCategoryModel struct {
 	Color       *string `json:"color,omitempty"`
 	Description *string `json:"description,omitempty"`
 }
+
+type Api_KeyModel struct {
+	Id        string     `json:"id"`
+	Prefix    string     `json:"prefix"`
+	Label     string     `json:"label"`
+	Owner     string     `json:"owner"`
+	Level     string     `json:"level"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"createdAt"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	// Whether write requests made with the key must be signed
+	Signed        bool    `json:"signed"`
+	SfwOnly       bool    `json:"sfwOnly"`
+	Key           *string `json:"key,omitempty"`
+	SigningSecret *string `json:"signingSecret,omitempty"`
+}
+
+type Api_AuditEntryModel struct {
+	Id        int           `json:"id"`
+	Timestamp time.Time     `json:"timestamp"`
+	KeyId     string        `json:"keyId"`
+	KeyLabel  string        `json:"keyLabel"`
+	Method    string        `json:"method"`
+	Route     string        `json:"route"`
+	TagId     *int          `json:"tagId,omitempty"`
+	Before    *Api_TagModel `json:"before,omitempty"`
+	After     *Api_TagModel `json:"after,omitempty"`
+}
+
+type Api_GameSuggestionModel struct {
+	Id    string `json:"game_id"`
+	Title string `json:"title"`
+	// The title or alternate title which matched
+	Match string `json:"match"`
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often daily usage counts are written to the database
+const usageFlushInterval = 10 * time.Second
+
+type RateLimit struct {
+	// Requests per second refilled into the bucket, 0 for no limit
+	Rate float64 `json:"Rate"`
+	// Largest number of requests allowed at once, defaults to the rate rounded up
+	Burst int `json:"Burst"`
+	// Requests allowed per UTC day, 0 for no limit
+	DailyQuota int `json:"DailyQuota"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateDecision struct {
+	allowed    bool
+	reason     string
+	burst      int
+	remaining  int
+	reset      time.Time
+	dailyUsed  int
+	dayEnd     time.Time
+	retryAfter time.Duration
+}
+
+// Tracks token buckets in memory and daily usage counts, which are periodically added to the api_key_usage table
+type rateLimiter struct {
+	mu      sync.Mutex
+	db      *sql.DB
+	buckets map[string]*tokenBucket
+	day     string
+	usage   map[string]int
+	// Usage not yet written to the database
+	pending map[string]int
+}
+
+var limiter *rateLimiter
+
+func newRateLimiter(db *sql.DB) (*rateLimiter, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS api_key_usage (
+		keyId TEXT NOT NULL,
+		day TEXT NOT NULL,
+		count INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (keyId, day)
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	l := &rateLimiter{
+		db:      db,
+		buckets: map[string]*tokenBucket{},
+		day:     usageDay(time.Now()),
+		usage:   map[string]int{},
+		pending: map[string]int{},
+	}
+	rows, err := db.Query("SELECT keyId, count FROM api_key_usage WHERE api_key_usage.day = ?", l.day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var keyId string
+		var count int
+		err = rows.Scan(&keyId, &count)
+		if err != nil {
+			return nil, err
+		}
+		l.usage[keyId] = count
+	}
+	return l, rows.Err()
+}
+
+func usageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// Resolves the limits for a key, preferring its own over those configured for its level
+func rateLimitFor(record *ApiKeyRecord) *RateLimit {
+	if record.RateLimit != nil {
+		return record.RateLimit
+	}
+	limits := currentConfig().RateLimits
+	if limit, ok := limits[record.Level]; ok {
+		return &limit
+	}
+	if limit, ok := limits["default"]; ok {
+		return &limit
+	}
+	return nil
+}
+
+func (l *rateLimiter) allow(id string, limit RateLimit, now time.Time) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	today := usageDay(now)
+	if today != l.day {
+		// Counts for the previous day still get written under the day they were made on
+		go l.save(l.day, l.pending)
+		l.day = today
+		l.usage = map[string]int{}
+		l.pending = map[string]int{}
+	}
+	y, m, d := now.UTC().Date()
+	decision := rateDecision{
+		allowed:   true,
+		dailyUsed: l.usage[id],
+		dayEnd:    time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC),
+	}
+	if limit.DailyQuota > 0 && decision.dailyUsed >= limit.DailyQuota {
+		decision.allowed = false
+		decision.reason = "Daily Quota Exceeded"
+		decision.retryAfter = decision.dayEnd.Sub(now)
+		return decision
+	}
+	if limit.Rate > 0 {
+		decision.burst = limit.Burst
+		if decision.burst <= 0 {
+			decision.burst = int(math.Ceil(limit.Rate))
+		}
+		bucket, ok := l.buckets[id]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(decision.burst), last: now}
+			l.buckets[id] = bucket
+		}
+		bucket.tokens = math.Min(float64(decision.burst), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+		bucket.last = now
+		if bucket.tokens < 1 {
+			decision.allowed = false
+			decision.reason = "Rate Limit Exceeded"
+			decision.retryAfter = time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+			decision.reset = now.Add(decision.retryAfter)
+			return decision
+		}
+		bucket.tokens -= 1
+		decision.remaining = int(bucket.tokens)
+		decision.reset = now.Add(time.Duration((float64(decision.burst) - bucket.tokens) / limit.Rate * float64(time.Second)))
+	}
+	l.usage[id] += 1
+	l.pending[id] += 1
+	decision.dailyUsed += 1
+	return decision
+}
+
+func (l *rateLimiter) flush() {
+	l.mu.Lock()
+	day, pending := l.day, l.pending
+	l.pending = map[string]int{}
+	// Buckets left idle this long have refilled under any sensible limit, so behave the same as new ones
+	now := time.Now()
+	for id, bucket := range l.buckets {
+		if now.Sub(bucket.last) > time.Hour {
+			delete(l.buckets, id)
+		}
+	}
+	l.mu.Unlock()
+	l.save(day, pending)
+}
+
+// Adds usage to the database, then picks up usage made by any other instances sharing it
+func (l *rateLimiter) save(day string, pending map[string]int) {
+	for id, count := range pending {
+		_, err := l.db.Exec(`INSERT INTO api_key_usage (keyId, day, count) VALUES (?, ?, ?)
+			ON CONFLICT (keyId, day) DO UPDATE SET count = count + excluded.count`, id, day, count)
+		if err != nil {
+			log.Printf("Error saving key usage: %v", err)
+			continue
+		}
+		var total int
+		err = l.db.QueryRow("SELECT count FROM api_key_usage WHERE api_key_usage.keyId = ? AND api_key_usage.day = ?", id, day).Scan(&total)
+		if err != nil {
+			continue
+		}
+		l.mu.Lock()
+		if l.day == day {
+			l.usage[id] = total + l.pending[id]
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (l *rateLimiter) run() {
+	ticker := time.NewTicker(usageFlushInterval)
+	for range ticker.C {
+		l.flush()
+	}
+}
+
+// Applies the rate limit and daily quota of a key, writing the 429 response if it is over either
+func enforceRateLimit(w http.ResponseWriter, id string, limit *RateLimit) bool {
+	if limit == nil || limiter == nil {
+		return true
+	}
+	decision := limiter.allow(id, *limit, time.Now())
+	if decision.burst > 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(decision.reset.Unix(), 10))
+	}
+	if limit.DailyQuota > 0 {
+		w.Header().Set("X-RateLimit-Daily-Limit", strconv.Itoa(limit.DailyQuota))
+		remaining := limit.DailyQuota - decision.dailyUsed
+		if remaining < 0 {
+			remaining = 0
+		}
+		w.Header().Set("X-RateLimit-Daily-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Daily-Reset", strconv.FormatInt(decision.dayEnd.Unix(), 10))
+	}
+	if !decision.allowed {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(decision.retryAfter.Seconds()))))
+		sendApiResult(w, http.StatusTooManyRequests, decision.reason, nil)
+		return false
+	}
+	return true
+}
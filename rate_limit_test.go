@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(t *testing.T, now time.Time) *rateLimiter {
+	usageDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usageDb.SetMaxOpenConns(1)
+	t.Cleanup(func() { usageDb.Close() })
+	l, err := newRateLimiter(usageDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.day = usageDay(now)
+	return l
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(t, start)
+	limit := RateLimit{Rate: 1, Burst: 3}
+	for i := 0; i < 3; i++ {
+		decision := l.allow("key", limit, start)
+		if !decision.allowed || decision.remaining != 2-i {
+			t.Fatalf("request %d: got %+v, want allowed with %d remaining", i, decision, 2-i)
+		}
+	}
+	decision := l.allow("key", limit, start)
+	if decision.allowed || decision.reason != "Rate Limit Exceeded" || decision.retryAfter != time.Second {
+		t.Fatalf("got %+v, want rate limited for 1s", decision)
+	}
+	// Denied requests neither take a token nor count toward the day
+	if decision.dailyUsed != 3 {
+		t.Fatalf("got %d used today, want 3", decision.dailyUsed)
+	}
+	decision = l.allow("key", limit, start.Add(500*time.Millisecond))
+	if decision.allowed || decision.retryAfter != 500*time.Millisecond {
+		t.Fatalf("got %+v, want rate limited for 500ms", decision)
+	}
+	decision = l.allow("key", limit, start.Add(time.Second))
+	if !decision.allowed || decision.remaining != 0 {
+		t.Fatalf("got %+v, want one refilled token", decision)
+	}
+	// A long idle spell refills no more than the burst
+	later := start.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.allow("key", limit, later).allowed {
+			t.Fatalf("request %d after idling: want allowed", i)
+		}
+	}
+	if l.allow("key", limit, later).allowed {
+		t.Fatal("want the burst to cap the refill")
+	}
+	// Keys have buckets of their own
+	if !l.allow("other", limit, later).allowed {
+		t.Fatal("want another key to be unaffected")
+	}
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(t, start)
+	limit := RateLimit{Rate: 0.5}
+	decision := l.allow("key", limit, start)
+	if !decision.allowed || decision.burst != 1 {
+		t.Fatalf("got %+v, want allowed with a burst of 1", decision)
+	}
+	decision = l.allow("key", limit, start.Add(time.Second))
+	if decision.allowed || decision.retryAfter != time.Second {
+		t.Fatalf("got %+v, want half a token short for 1s", decision)
+	}
+}
+
+func TestRateLimiterDailyQuota(t *testing.T) {
+	start := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+	l := newTestRateLimiter(t, start)
+	limit := RateLimit{DailyQuota: 2}
+	for i := 0; i < 2; i++ {
+		if !l.allow("key", limit, start).allowed {
+			t.Fatalf("request %d: want allowed", i)
+		}
+	}
+	decision := l.allow("key", limit, start)
+	if decision.allowed || decision.reason != "Daily Quota Exceeded" || decision.retryAfter != time.Hour {
+		t.Fatalf("got %+v, want over quota until midnight UTC", decision)
+	}
+	// The quota starts over on the next UTC day
+	decision = l.allow("key", limit, start.Add(time.Hour))
+	if !decision.allowed || decision.dailyUsed != 1 {
+		t.Fatalf("got %+v, want allowed as the first request of the day", decision)
+	}
+}
+
+func TestRateLimitFor(t *testing.T) {
+	custom := &RateLimit{Rate: 2}
+	record := &ApiKeyRecord{Level: "generic", RateLimit: custom}
+	if rateLimitFor(record) != custom {
+		t.Fatal("want a key's own limit to win over its level's")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often the settings files are checked for changes
+const settingsPollInterval = 2 * time.Second
+
+var settingsFiles = []string{"./master_key", "./config.json", "./write_keys", "./generic_keys"}
+
+// Guards master_key and config, which are swapped out whole on reload
+var settingsMu sync.RWMutex
+
+// Stops overlapping reloads from the watcher and the reload endpoint
+var reloadMu sync.Mutex
+
+func currentConfig() ConfigFile {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return config
+}
+
+func currentMasterKey() string {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return master_key
+}
+
+func readMasterKey() (string, error) {
+	raw_master_key, err := os.ReadFile("./master_key")
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(raw_master_key))
+	if key == "" {
+		return "", errors.New("Please fill in the master_key file")
+	}
+	return key, nil
+}
+
+// Reloads the master key, keys and any config settings which can change without a restart.
+// Nothing is changed if the master key, config or JWKS file can't be read.
+func reloadSettings() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	newMasterKey, err := readMasterKey()
+	if err != nil {
+		return err
+	}
+	newConfig, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	oldConfig := currentConfig()
+	// These need connections or stores reopened, so only change on restart
+	for _, setting := range []struct{ name, old, new string }{
+		{"Port", oldConfig.Port, newConfig.Port},
+		{"EsUri", oldConfig.EsUri, newConfig.EsUri},
+		{"DbPath", oldConfig.DbPath, newConfig.DbPath},
+		{"KeyStore", oldConfig.KeyStore, newConfig.KeyStore},
+		{"SearchBackend", oldConfig.SearchBackend, newConfig.SearchBackend},
+	} {
+		if setting.old != setting.new {
+			log.Printf("%s changed, restart to apply it", setting.name)
+		}
+	}
+	newConfig.Port = oldConfig.Port
+	newConfig.EsUri = oldConfig.EsUri
+	newConfig.DbPath = oldConfig.DbPath
+	newConfig.KeyStore = oldConfig.KeyStore
+	newConfig.SearchBackend = oldConfig.SearchBackend
+	newJwksKeys, err := readJwks(newConfig.Jwt)
+	if err != nil {
+		return err
+	}
+	// Swapped together so a token is never checked against the new config with the old keys
+	settingsMu.Lock()
+	jwksMu.Lock()
+	master_key = newMasterKey
+	config = newConfig
+	jwksKeys = newJwksKeys
+	jwksMu.Unlock()
+	settingsMu.Unlock()
+	err = keyStore.Reload()
+	if err != nil {
+		return err
+	}
+	return importAllLegacyKeys(keyStore)
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statSettingsFiles() map[string]fileStamp {
+	stamps := map[string]fileStamp{}
+	paths := settingsFiles
+	if jwtConfig := currentConfig().Jwt; jwtConfig != nil && jwtConfig.JwksPath != "" {
+		paths = append(paths[:len(paths):len(paths)], jwtConfig.JwksPath)
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err == nil {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// Reloads settings on SIGHUP or when any of the settings files change on disk
+func watchSettings() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(settingsPollInterval)
+	lastStamps := statSettingsFiles()
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading settings")
+		case <-ticker.C:
+			stamps := statSettingsFiles()
+			changed := len(stamps) != len(lastStamps)
+			for path, stamp := range stamps {
+				if lastStamps[path] != stamp {
+					changed = true
+				}
+			}
+			if !changed {
+				// Picks up keys added to the store by other instances or by hand
+				err := keyStore.Reload()
+				if err != nil {
+					log.Printf("Error reloading api keys: %v", err)
+				}
+				continue
+			}
+			log.Println("Settings files changed, reloading settings")
+		}
+		err := reloadSettings()
+		if err != nil {
+			log.Printf("Error reloading settings, keeping previous settings: %v", err)
+		} else {
+			log.Println("Settings reloaded")
+		}
+		// Importing legacy keys empties their files, which shouldn't count as another change
+		lastStamps = statSettingsFiles()
+	}
+}
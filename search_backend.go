@@ -0,0 +1,68 @@
+package main
+
+import "log"
+
+// SearchBackend indexes games and answers searches. Implementations must be safe for use from many goroutines.
+type SearchBackend interface {
+	// Replaces everything indexed with the given games
+	IndexGames(games []Game) error
+	Search(gameSearch *GameSearch) (*SearchResult, error)
+	// Returns the game with the given id, or nil if there is none
+	FindGameById(id string) (*Game, error)
+	// Returns an error if the backend can't currently answer searches
+	Health() error
+}
+
+// Optional extras, for backends able to offer them
+
+type GameSuggester interface {
+	SuggestGames(prefix string, extreme bool, size int) ([]Api_GameSuggestionModel, error)
+}
+
+type RandomGamePicker interface {
+	RandomGames(gameSearch *GameSearch, count int, seed string) ([]Game, error)
+}
+
+type RelatedGameFinder interface {
+	RelatedGames(game *Game, gameSearch *GameSearch, limit int) ([]Game, error)
+}
+
+var searchBackend SearchBackend
+
+// Implemented by backends which keep their own copy of the games, so a new install can be indexed on startup
+type EmptyChecker interface {
+	// Returns true if no games have been indexed
+	IsEmpty() (bool, error)
+}
+
+// Indexes the games on startup if the backend has none yet. Later changes need POST /api/admin/reindex.
+func indexIfEmpty() error {
+	checker, ok := searchBackend.(EmptyChecker)
+	if !ok {
+		return nil
+	}
+	empty, err := checker.IsEmpty()
+	if err != nil || !empty {
+		return err
+	}
+	count, err := populateEs()
+	if err != nil {
+		return err
+	}
+	log.Printf("Total Games Loaded: %d", count)
+	return nil
+}
+
+func openSearchBackend(backend string) (SearchBackend, error) {
+	switch backend {
+	case "", "elasticsearch":
+		es, err := newEsSearchBackend(currentConfig().EsUri)
+		if err != nil {
+			return nil, err
+		}
+		return newFailoverSearchBackend(es, newDbSearchBackend(db)), nil
+	case "sqlite":
+		return newSqliteSearchBackend(db)
+	}
+	return nil, &UnknownBackendError{kind: "SearchBackend", name: backend}
+}
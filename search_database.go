@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+)
+
+// Searches the game table directly with LIKE, for answering while the configured backend is down.
+// Has no index of its own to go stale. Queries are matched as plain terms whatever the mode,
+// and results come back without relevance ranking, facets or highlights.
+type dbSearchBackend struct {
+	db *sql.DB
+}
+
+// Turns a "a; b" list column into the ";a;b;" form addGameFilters expects
+func dbListColumn(column string) string {
+	return "';' || REPLACE(" + column + ", '; ', ';') || ';'"
+}
+
+// SQL expressions for the fields filtered and sorted on, by the names used in game_search
+var dbGameColumns = map[string]string{
+	"title":        "IFNULL(game.title, '')",
+	"developer":    "IFNULL(game.developer, '')",
+	"publisher":    "IFNULL(game.publisher, '')",
+	"series":       "IFNULL(game.series, '')",
+	"platform":     "game.platform",
+	"library":      "game.library",
+	"playModes":    dbListColumn("game.playMode"),
+	"statuses":     dbListColumn("game.status"),
+	"languages":    dbListColumn("game.language"),
+	"tags":         dbListColumn("game.tagsStr"),
+	"dateAdded":    "game.dateAdded",
+	"dateModified": "game.dateModified",
+	"releaseDate":  "game.releaseDate",
+	"extreme":      "game.extreme",
+}
+
+// Columns each query term is looked for in
+var dbSearchColumns = []string{"game.title", "game.alternateTitles", "game.developer", "game.publisher", "game.series", "game.tagsStr"}
+
+func newDbSearchBackend(db *sql.DB) *dbSearchBackend {
+	return &dbSearchBackend{db: db}
+}
+
+// Games are read straight from the game table, so there's nothing to index
+func (s *dbSearchBackend) IndexGames(games []Game) error {
+	return nil
+}
+
+func (s *dbSearchBackend) Search(gameSearch *GameSearch) (*SearchResult, error) {
+	if gameSearch.Cursor != nil {
+		return nil, &SearchRequestError{status: http.StatusServiceUnavailable, message: "Cursors are unavailable while search is degraded"}
+	}
+	q := &sqliteSearchQuery{}
+	terms := strings.Fields(gameSearch.Query)
+	if gameSearch.Mode == QueryModePhrase && strings.TrimSpace(gameSearch.Query) != "" {
+		terms = []string{strings.TrimSpace(gameSearch.Query)}
+	}
+	for _, term := range terms {
+		var conditions []string
+		var args []interface{}
+		for _, column := range dbSearchColumns {
+			conditions = append(conditions, column+` LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+likeEscaper.Replace(term)+"%")
+		}
+		q.add("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+	addGameFilters(gameSearch, q, func(name string) string { return dbGameColumns[name] })
+
+	var total float64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM game"+q.whereClause(), q.args...).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	sortKeys, err := parseGameSort(gameSearch.Sort, gameSearch.Order)
+	if err != nil {
+		return nil, &SearchRequestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	var orderBy []string
+	for _, key := range sortKeys {
+		direction := strings.ToUpper(key.order)
+		column := dbGameColumns[key.name]
+		switch key.name {
+		case "relevance":
+			// Nothing to rank by, the title order below stands in
+			continue
+		case "title":
+			orderBy = append(orderBy, column+" COLLATE NOCASE "+direction)
+		default:
+			orderBy = append(orderBy, column+" = '' ASC", column+" "+direction)
+		}
+	}
+	orderBy = append(orderBy, dbGameColumns["title"]+" COLLATE NOCASE ASC", "game.id ASC")
+
+	args := append(q.args, gameSearch.Limit, (gameSearch.Page-1)*gameSearch.Limit)
+	rows, err := s.db.Query("SELECT * FROM game"+q.whereClause()+
+		" ORDER BY "+strings.Join(orderBy, ", ")+" LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var games []Game
+	for rows.Next() {
+		game, err := scanGame(rows)
+		if err != nil {
+			return nil, err
+		}
+		games = append(games, game)
+	}
+	return &SearchResult{Games: games, Total: total}, rows.Err()
+}
+
+func (s *dbSearchBackend) FindGameById(id string) (*Game, error) {
+	rows, err := s.db.Query("SELECT * FROM game WHERE game.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	game, err := scanGame(rows)
+	if err != nil {
+		return nil, err
+	}
+	return &game, nil
+}
+
+func (s *dbSearchBackend) Health() error {
+	return s.db.Ping()
+}
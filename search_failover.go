@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// How often the primary backend's health is checked
+const searchHealthCheckInterval = 30 * time.Second
+
+var errSearchDegraded = &SearchRequestError{status: http.StatusServiceUnavailable, message: "Unavailable while search is degraded"}
+
+var errSearchNotSupported = &SearchRequestError{status: http.StatusNotImplemented, message: "Not supported by the search backend"}
+
+// Serves from the primary backend, switching to the fallback while the primary is down.
+// Results from the fallback are marked degraded. Suggestions, random and related games have no
+// fallback and fail with a 503 until the primary is back.
+type failoverSearchBackend struct {
+	primary  SearchBackend
+	fallback SearchBackend
+	// 1 while the fallback is serving
+	degraded int32
+}
+
+func newFailoverSearchBackend(primary SearchBackend, fallback SearchBackend) *failoverSearchBackend {
+	b := &failoverSearchBackend{primary: primary, fallback: fallback}
+	b.check()
+	return b
+}
+
+func (b *failoverSearchBackend) isDegraded() bool {
+	return atomic.LoadInt32(&b.degraded) == 1
+}
+
+// Checks the primary's health, switching to or from the fallback when it changes
+func (b *failoverSearchBackend) check() {
+	err := b.primary.Health()
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&b.degraded, 0, 1) {
+			log.Printf("Search backend unavailable, serving degraded results from the database: %v", err)
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&b.degraded, 1, 0) {
+		log.Println("Search backend recovered, no longer degraded")
+	}
+}
+
+func (b *failoverSearchBackend) run() {
+	ticker := time.NewTicker(searchHealthCheckInterval)
+	for range ticker.C {
+		b.check()
+	}
+}
+
+// Reports whether an error from the primary means it's down, rather than the request being at fault
+func (b *failoverSearchBackend) failed(err error) bool {
+	if _, ok := err.(*SearchRequestError); ok {
+		return false
+	}
+	b.check()
+	return b.isDegraded()
+}
+
+func (b *failoverSearchBackend) IndexGames(games []Game) error {
+	return b.primary.IndexGames(games)
+}
+
+func (b *failoverSearchBackend) Search(gameSearch *GameSearch) (*SearchResult, error) {
+	if !b.isDegraded() {
+		result, err := b.primary.Search(gameSearch)
+		if err == nil || !b.failed(err) {
+			return result, err
+		}
+	}
+	result, err := b.fallback.Search(gameSearch)
+	if err != nil {
+		return nil, err
+	}
+	result.Degraded = true
+	return result, nil
+}
+
+func (b *failoverSearchBackend) FindGameById(id string) (*Game, error) {
+	game, _, err := b.findGameById(id)
+	return game, err
+}
+
+// Finds the game with the given id, also reporting whether the fallback answered
+func (b *failoverSearchBackend) findGameById(id string) (*Game, bool, error) {
+	if !b.isDegraded() {
+		game, err := b.primary.FindGameById(id)
+		if err == nil || !b.failed(err) {
+			return game, false, err
+		}
+	}
+	game, err := b.fallback.FindGameById(id)
+	return game, true, err
+}
+
+func (b *failoverSearchBackend) Health() error {
+	if b.isDegraded() {
+		return b.fallback.Health()
+	}
+	return b.primary.Health()
+}
+
+func (b *failoverSearchBackend) SuggestGames(prefix string, extreme bool, size int) ([]Api_GameSuggestionModel, error) {
+	suggester, ok := b.primary.(GameSuggester)
+	if !ok {
+		return nil, errSearchNotSupported
+	}
+	if b.isDegraded() {
+		return nil, errSearchDegraded
+	}
+	suggestions, err := suggester.SuggestGames(prefix, extreme, size)
+	if err != nil && b.failed(err) {
+		return nil, errSearchDegraded
+	}
+	return suggestions, err
+}
+
+func (b *failoverSearchBackend) RandomGames(gameSearch *GameSearch, count int, seed string) ([]Game, error) {
+	picker, ok := b.primary.(RandomGamePicker)
+	if !ok {
+		return nil, errSearchNotSupported
+	}
+	if b.isDegraded() {
+		return nil, errSearchDegraded
+	}
+	games, err := picker.RandomGames(gameSearch, count, seed)
+	if err != nil && b.failed(err) {
+		return nil, errSearchDegraded
+	}
+	return games, err
+}
+
+func (b *failoverSearchBackend) RelatedGames(game *Game, gameSearch *GameSearch, limit int) ([]Game, error) {
+	finder, ok := b.primary.(RelatedGameFinder)
+	if !ok {
+		return nil, errSearchNotSupported
+	}
+	if b.isDegraded() {
+		return nil, errSearchDegraded
+	}
+	games, err := finder.RelatedGames(game, gameSearch, limit)
+	if err != nil && b.failed(err) {
+		return nil, errSearchDegraded
+	}
+	return games, err
+}
+
+// Finds the game with the given id, also reporting whether it came from a fallback
+func lookupGame(id string) (*Game, bool, error) {
+	if failover, ok := searchBackend.(*failoverSearchBackend); ok {
+		return failover.findGameById(id)
+	}
+	game, err := searchBackend.FindGameById(id)
+	return game, false, err
+}
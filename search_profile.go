@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Index fields searched for each name usable in SearchProfile.Boosts
+var profileFields = map[string][]string{
+	"title":           {"title"},
+	"alternateTitles": {"alternateTitles"},
+	"series":          {"series"},
+	"developer":       {"developer"},
+	"publisher":       {"publisher"},
+	"tags":            {"tagsStr"},
+	"description":     {"originalDescription"},
+	"notes":           {"notes"},
+}
+
+// Used when the config has no "default" profile, so titles count for more than notes
+var defaultSearchProfile = SearchProfile{
+	Boosts: map[string]float64{
+		"title":           4,
+		"alternateTitles": 3,
+		"series":          2,
+		"developer":       1.5,
+		"publisher":       1,
+		"tags":            1.5,
+		"description":     1,
+		"notes":           0.5,
+	},
+}
+
+type SearchProfile struct {
+	// Weight of a match in each field, fields not listed aren't searched. Unset to search every field equally.
+	Boosts map[string]float64 `json:"Boosts"`
+	// Favours games with a recent date, unset for no preference
+	Recency *RecencyBoost `json:"Recency"`
+	// Added to the score multiplier of games with each status, e.g. {"Playable": 0.5}
+	StatusBoosts map[string]float64 `json:"StatusBoosts"`
+}
+
+type RecencyBoost struct {
+	// One of ("dateAdded", "dateModified", "releaseDate")
+	Field string `json:"Field"`
+	// How far from now the boost has halved, as an Elasticsearch duration e.g. "365d"
+	Scale string `json:"Scale"`
+	// Added to the score multiplier of games dated now, defaults to 1
+	Weight float64 `json:"Weight"`
+}
+
+// Looks up a profile by name, with "" meaning the default one
+func searchProfile(name string) (*SearchProfile, error) {
+	profiles := currentConfig().SearchProfiles
+	if name == "" {
+		name = "default"
+	}
+	if profile, ok := profiles[name]; ok {
+		return &profile, nil
+	}
+	if name == "default" {
+		return &defaultSearchProfile, nil
+	}
+	names := []string{"default"}
+	for known := range profiles {
+		if known != "default" {
+			names = append(names, known)
+		}
+	}
+	sort.Strings(names[1:])
+	return nil, fmt.Errorf("Unknown profile '%s', must be of ('%s')", name, strings.Join(names, "', '"))
+}
+
+func validateSearchProfiles(profiles map[string]SearchProfile) error {
+	for name, profile := range profiles {
+		for field := range profile.Boosts {
+			if _, ok := profileFields[field]; !ok {
+				return fmt.Errorf("search profile '%s' boosts unknown field '%s'", name, field)
+			}
+		}
+		if profile.Recency != nil {
+			switch profile.Recency.Field {
+			case "dateAdded", "dateModified", "releaseDate":
+			default:
+				return fmt.Errorf("search profile '%s' has unknown recency field '%s'", name, profile.Recency.Field)
+			}
+			if profile.Recency.Scale == "" {
+				return fmt.Errorf("search profile '%s' needs a recency scale", name)
+			}
+		}
+	}
+	return nil
+}
+
+// The fields a text query searches, with their boosts, e.g. "title^4"
+func (p *SearchProfile) queryFields() []string {
+	if len(p.Boosts) == 0 {
+		return []string{"*"}
+	}
+	var fields []string
+	for name, boost := range p.Boosts {
+		for _, field := range profileFields[name] {
+			fields = append(fields, fmt.Sprintf("%s^%g", field, boost))
+		}
+	}
+	// Map order is random, keep queries the same from one request to the next
+	sort.Strings(fields)
+	return fields
+}
+
+// Scoring functions applied on top of the text match, empty if the profile has none.
+// They're summed into a multiplier starting from 1, so games without a boost keep their text score.
+func (p *SearchProfile) scoreFunctions() []interface{} {
+	if p.Recency == nil && len(p.StatusBoosts) == 0 {
+		return nil
+	}
+	functions := []interface{}{
+		map[string]interface{}{
+			"weight": 1,
+		},
+	}
+	if p.Recency != nil {
+		weight := p.Recency.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		functions = append(functions, map[string]interface{}{
+			"gauss": map[string]interface{}{
+				p.Recency.Field: map[string]interface{}{
+					"origin": "now",
+					"scale":  p.Recency.Scale,
+					"decay":  0.5,
+				},
+			},
+			"weight": weight,
+		})
+	}
+	statuses := make([]string, 0, len(p.StatusBoosts))
+	for status := range p.StatusBoosts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		functions = append(functions, map[string]interface{}{
+			"filter": map[string]interface{}{
+				"term": map[string]interface{}{
+					"statuses": status,
+				},
+			},
+			"weight": p.StatusBoosts[status],
+		})
+	}
+	return functions
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// Serves searches from FTS5 tables kept in the main database, for running without an Elasticsearch cluster.
+// Facets, cursors, suggestions, random and related games are left to the Elasticsearch backend.
+// Needs a build with -tags sqlite_fts5, and is filled on first startup or by POST /api/admin/reindex.
+type sqliteSearchBackend struct {
+	db *sql.DB
+}
+
+// Columns of game_search_fts, in order, by the names used in SearchProfile.Boosts
+var sqliteSearchColumns = []string{"title", "alternateTitles", "developer", "publisher", "series", "tags", "description", "notes"}
+
+func newSqliteSearchBackend(db *sql.DB) (*sqliteSearchBackend, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS game_search (
+		id INTEGER PRIMARY KEY,
+		gameId TEXT NOT NULL UNIQUE,
+		title TEXT NOT NULL DEFAULT '',
+		developer TEXT NOT NULL DEFAULT '',
+		publisher TEXT NOT NULL DEFAULT '',
+		series TEXT NOT NULL DEFAULT '',
+		platform TEXT NOT NULL DEFAULT '',
+		library TEXT NOT NULL DEFAULT '',
+		playModes TEXT NOT NULL DEFAULT '',
+		statuses TEXT NOT NULL DEFAULT '',
+		languages TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '',
+		dateAdded TEXT NOT NULL DEFAULT '',
+		dateModified TEXT NOT NULL DEFAULT '',
+		releaseDate TEXT NOT NULL DEFAULT '',
+		extreme INTEGER NOT NULL DEFAULT 0,
+		data TEXT NOT NULL
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS game_search_fts USING fts5(
+		title, alternateTitles, developer, publisher, series, tagsStr, originalDescription, notes,
+		tokenize = 'unicode61 remove_diacritics 2'
+	)`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return nil, errors.New("the sqlite search backend needs SQLite with FTS5, build the service with '-tags sqlite_fts5'")
+		}
+		return nil, err
+	}
+	return &sqliteSearchBackend{db: db}, nil
+}
+
+// Stores a ';' separated list as ";a;b;" so single values can be matched with LIKE '%;a;%'
+func joinSearchList(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return ";" + strings.Join(values, ";") + ";"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *sqliteSearchBackend) IndexGames(games []Game) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM game_search")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM game_search_fts")
+	if err != nil {
+		return err
+	}
+	for _, game := range games {
+		doc := newGameDocument(game)
+		data, err := json.Marshal(game)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(`INSERT INTO game_search (gameId, title, developer, publisher, series, platform, library,
+			playModes, statuses, languages, tags, dateAdded, dateModified, releaseDate, extreme, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			game.Id, game.Title, game.Developer, game.Publisher, game.Series, game.Platform, game.Library,
+			joinSearchList(doc.PlayModes), joinSearchList(doc.Statuses), joinSearchList(doc.Languages), joinSearchList(doc.Tags),
+			game.DateAdded, game.DateModified, game.ReleaseDate, game.Extreme, string(data))
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO game_search_fts (rowid, title, alternateTitles, developer, publisher, series, tagsStr, originalDescription, notes)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, game.Title, game.AlternateTitles, game.Developer, game.Publisher, game.Series, game.TagsStr, game.OriginalDescription, game.Notes)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Turns the query into FTS5 syntax. Only lucene mode passes the caller's syntax through, as FTS5 syntax.
+func sqliteMatchQuery(gameSearch *GameSearch) string {
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	}
+	switch gameSearch.Mode {
+	case QueryModePhrase:
+		return quote(gameSearch.Query)
+	case QueryModeLucene:
+		return gameSearch.Query
+	}
+	terms := strings.Fields(gameSearch.Query)
+	for i, term := range terms {
+		terms[i] = quote(term)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Weights for bm25, one per column of game_search_fts
+func sqliteColumnWeights(profile *SearchProfile) string {
+	weights := make([]string, len(sqliteSearchColumns))
+	for i, name := range sqliteSearchColumns {
+		weight := 1.0
+		if len(profile.Boosts) > 0 {
+			weight = profile.Boosts[name]
+		}
+		weights[i] = fmt.Sprintf("%g", weight)
+	}
+	return strings.Join(weights, ", ")
+}
+
+type sqliteSearchQuery struct {
+	where []string
+	args  []interface{}
+}
+
+func (q *sqliteSearchQuery) add(clause string, args ...interface{}) {
+	q.where = append(q.where, clause)
+	q.args = append(q.args, args...)
+}
+
+// Adds a clause matching any of the values, each tested with the given single value condition
+func (q *sqliteSearchQuery) addAny(negate bool, condition string, values []string, arg func(string) string) {
+	var conditions []string
+	for _, value := range values {
+		conditions = append(conditions, condition)
+		q.args = append(q.args, arg(value))
+	}
+	clause := "(" + strings.Join(conditions, " OR ") + ")"
+	if negate {
+		clause = "NOT " + clause
+	}
+	q.where = append(q.where, clause)
+}
+
+func (q *sqliteSearchQuery) whereClause() string {
+	if len(q.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(q.where, " AND ")
+}
+
+// Adds the search's filters to the query. Column maps each filter to the SQL expression it tests,
+// with list fields given in the ";a;b;" form of joinSearchList.
+func addGameFilters(gameSearch *GameSearch, q *sqliteSearchQuery, column func(name string) string) {
+	listValue := func(value string) string {
+		return "%;" + likeEscaper.Replace(value) + ";%"
+	}
+	containsValue := func(value string) string {
+		return "%" + likeEscaper.Replace(value) + "%"
+	}
+	for _, filter := range []struct {
+		column string
+		values []string
+		// Builds the LIKE pattern for a value, nil to compare values exactly
+		pattern func(string) string
+	}{
+		{"platform", gameSearch.Platform, nil},
+		{"library", gameSearch.Library, nil},
+		{"playModes", gameSearch.PlayMode, listValue},
+		{"statuses", gameSearch.Status, listValue},
+		{"languages", gameSearch.Language, listValue},
+		{"developer", gameSearch.Developer, containsValue},
+		{"publisher", gameSearch.Publisher, containsValue},
+		{"series", gameSearch.Series, containsValue},
+	} {
+		if len(filter.values) == 0 {
+			continue
+		}
+		if filter.pattern == nil {
+			q.addAny(false, column(filter.column)+" = ?", filter.values, func(value string) string { return value })
+		} else {
+			q.addAny(false, column(filter.column)+` LIKE ? ESCAPE '\'`, filter.values, filter.pattern)
+		}
+	}
+	for _, tag := range gameSearch.IncludeTags {
+		q.addAny(false, column("tags")+` LIKE ? ESCAPE '\'`, gameSearch.tagNames(tag), listValue)
+	}
+	for _, tag := range gameSearch.ExcludeTags {
+		q.addAny(true, column("tags")+` LIKE ? ESCAPE '\'`, gameSearch.tagNames(tag), listValue)
+	}
+	if !gameSearch.Extreme {
+		q.add(column("extreme") + " = 0")
+	}
+	for _, dateRange := range []struct {
+		column string
+		bounds *DateRange
+	}{
+		{"dateAdded", gameSearch.DateAdded},
+		{"releaseDate", gameSearch.ReleaseDate},
+	} {
+		if dateRange.bounds == nil {
+			continue
+		}
+		if dateRange.bounds.From != "" {
+			q.add(column(dateRange.column)+" >= ?", dateRange.bounds.From)
+		}
+		if dateRange.bounds.To != "" {
+			// Dates are compared as text, so "2010-05-01" would otherwise fall after a bound of "2010"
+			q.add(column(dateRange.column)+" <= ?", dateRange.bounds.To+"\uffff")
+		}
+	}
+}
+
+func (s *sqliteSearchBackend) Search(gameSearch *GameSearch) (*SearchResult, error) {
+	if len(gameSearch.Facets) > 0 {
+		return nil, &SearchRequestError{status: http.StatusBadRequest, message: "Facets are not supported by the sqlite search backend"}
+	}
+	if gameSearch.Cursor != nil {
+		return nil, &SearchRequestError{status: http.StatusBadRequest, message: "Cursors are not supported by the sqlite search backend"}
+	}
+	profile, err := searchProfile(gameSearch.Profile)
+	if err != nil {
+		profile = &defaultSearchProfile
+	}
+	from := "game_search"
+	q := &sqliteSearchQuery{}
+	rank := ""
+	if gameSearch.Query != "" {
+		from += " JOIN game_search_fts ON game_search_fts.rowid = game_search.id"
+		q.add("game_search_fts MATCH ?", sqliteMatchQuery(gameSearch))
+		rank = fmt.Sprintf("bm25(game_search_fts, %s)", sqliteColumnWeights(profile))
+	}
+	addGameFilters(gameSearch, q, func(name string) string { return "game_search." + name })
+
+	var total float64
+	err = s.db.QueryRow("SELECT COUNT(*) FROM "+from+q.whereClause(), q.args...).Scan(&total)
+	if err != nil {
+		return nil, sqliteSearchError(gameSearch, err)
+	}
+
+	sortKeys, err := parseGameSort(gameSearch.Sort, gameSearch.Order)
+	if err != nil {
+		return nil, &SearchRequestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	var orderBy []string
+	for _, key := range sortKeys {
+		direction := strings.ToUpper(key.order)
+		switch key.name {
+		case "relevance":
+			if rank == "" {
+				continue
+			}
+			// bm25 scores better matches lower
+			if direction == "ASC" {
+				direction = "DESC"
+			} else {
+				direction = "ASC"
+			}
+			orderBy = append(orderBy, rank+" "+direction)
+		case "title":
+			orderBy = append(orderBy, "game_search.title COLLATE NOCASE "+direction)
+		default:
+			// Games without a value go last either way, as they do in Elasticsearch
+			column := "game_search." + key.name
+			orderBy = append(orderBy, column+" = '' ASC", column+" "+direction)
+		}
+	}
+	orderBy = append(orderBy, "game_search.id ASC")
+
+	columns := "game_search.data"
+	var highlightArgs []interface{}
+	highlight := gameSearch.Highlight && gameSearch.Query != ""
+	if highlight {
+		// Marked with control characters, then escaped and tagged, as FTS5 wraps matches in the raw text
+		pre, post := sqliteHighlightStart, sqliteHighlightEnd
+		columns += ", highlight(game_search_fts, 0, ?, ?), highlight(game_search_fts, 1, ?, ?)" +
+			", snippet(game_search_fts, 6, ?, ?, '...', 24), snippet(game_search_fts, 7, ?, ?, '...', 24)"
+		highlightArgs = []interface{}{pre, post, pre, post, pre, post, pre, post}
+	}
+	args := append(highlightArgs, q.args...)
+	args = append(args, gameSearch.Limit, (gameSearch.Page-1)*gameSearch.Limit)
+	rows, err := s.db.Query("SELECT "+columns+" FROM "+from+q.whereClause()+
+		" ORDER BY "+strings.Join(orderBy, ", ")+" LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		return nil, sqliteSearchError(gameSearch, err)
+	}
+	defer rows.Close()
+	var games []Game
+	for rows.Next() {
+		var data string
+		var fragments [4]string
+		dest := []interface{}{&data}
+		if highlight {
+			dest = append(dest, &fragments[0], &fragments[1], &fragments[2], &fragments[3])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		var game Game
+		err = json.Unmarshal([]byte(data), &game)
+		if err != nil {
+			return nil, err
+		}
+		if highlight {
+			for i, field := range []string{"title", "alternateTitles", "originalDescription", "notes"} {
+				// Fields come back whether or not they matched
+				if strings.Contains(fragments[i], sqliteHighlightStart) {
+					if game.Highlights == nil {
+						game.Highlights = map[string][]string{}
+					}
+					game.Highlights[field] = []string{sqliteHighlightHtml(fragments[i], gameSearch)}
+				}
+			}
+		}
+		games = append(games, game)
+	}
+	return &SearchResult{Games: games, Total: total}, rows.Err()
+}
+
+const sqliteHighlightStart = "\x01"
+const sqliteHighlightEnd = "\x02"
+
+// Escapes a marked FTS5 fragment as HTML, as Elasticsearch's html encoder does, then swaps in the search's tags
+func sqliteHighlightHtml(fragment string, gameSearch *GameSearch) string {
+	escaped := html.EscapeString(fragment)
+	return strings.NewReplacer(sqliteHighlightStart, gameSearch.HighlightPreTag, sqliteHighlightEnd, gameSearch.HighlightPostTag).Replace(escaped)
+}
+
+// Lucene mode queries are written by the caller, so FTS5 failing to parse one is their mistake
+func sqliteSearchError(gameSearch *GameSearch, err error) error {
+	if gameSearch.Mode == QueryModeLucene && strings.Contains(err.Error(), "fts5") {
+		return &SearchRequestError{status: http.StatusBadRequest, message: "Invalid Query: " + err.Error()}
+	}
+	return err
+}
+
+func (s *sqliteSearchBackend) FindGameById(id string) (*Game, error) {
+	var data string
+	err := s.db.QueryRow("SELECT data FROM game_search WHERE game_search.gameId = ?", id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var game Game
+	err = json.Unmarshal([]byte(data), &game)
+	if err != nil {
+		return nil, err
+	}
+	return &game, nil
+}
+
+func (s *sqliteSearchBackend) IsEmpty() (bool, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM (SELECT 1 FROM game_search LIMIT 1)").Scan(&count)
+	return count == 0, err
+}
+
+func (s *sqliteSearchBackend) Health() error {
+	var count int
+	return s.db.QueryRow("SELECT COUNT(*) FROM (SELECT 1 FROM game_search_fts LIMIT 1)").Scan(&count)
+}
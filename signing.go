@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Used when the config doesn't set how far a signature timestamp may be from the server clock
+const defaultSignatureMaxSkew = 5 * time.Minute
+
+// Largest body read to check a signature
+const maxSignedBodySize = 1 << 20
+
+// Implemented by key stores shared between instances, so a request can't be replayed against another instance
+type NonceStore interface {
+	// Records the nonce until it expires, returning false if it was already used
+	UseNonce(nonce string, expires time.Time) (bool, error)
+}
+
+// Returned when the nonce couldn't be recorded, a server fault rather than a bad signature
+var errNonceCheckFailed = errors.New("Unable to check signature nonce")
+
+// Remembers nonces until their timestamp falls out of the allowed window, so requests can't be replayed.
+// Only covers this instance, used when the key store doesn't keep nonces itself.
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	sweeps int
+}
+
+var usedNonces = &nonceCache{seen: map[string]time.Time{}}
+
+// Returns false if the nonce was already used
+func (c *nonceCache) use(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.sweeps += 1
+	if c.sweeps >= 1000 {
+		c.sweeps = 0
+		for seen, expiry := range c.seen {
+			if now.After(expiry) {
+				delete(c.seen, seen)
+			}
+		}
+	}
+	if expiry, ok := c.seen[nonce]; ok && now.Before(expiry) {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+func isWriteScope(scope string) bool {
+	return strings.HasSuffix(scope, ":write")
+}
+
+func newSigningSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// The string signed by the client:
+// METHOD \n REQUEST URI \n HEX SHA256 OF BODY \n TIMESTAMP \n NONCE
+func signingPayload(r *http.Request, body []byte, timestamp string, nonce string) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		r.Method,
+		r.URL.RequestURI(),
+		hex.EncodeToString(bodyHash[:]),
+		timestamp,
+		nonce,
+	}, "\n"))
+}
+
+func signatureMaxSkew() time.Duration {
+	if currentConfig().SignatureMaxSkew != "" {
+		skew, err := time.ParseDuration(currentConfig().SignatureMaxSkew)
+		if err == nil {
+			return skew
+		}
+	}
+	return defaultSignatureMaxSkew
+}
+
+// Checks the X-Signature headers of a request against the key's signing secret.
+// The body is read and replaced so handlers can still decode it.
+func verifySignature(r *http.Request, record *ApiKeyRecord) error {
+	if record.SigningSecret == "" {
+		return errors.New("Key must have a signing secret to use this route")
+	}
+	signature := r.Header.Get("X-Signature")
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	nonce := r.Header.Get("X-Signature-Nonce")
+	if signature == "" || timestamp == "" || nonce == "" {
+		return errors.New("Request must be signed with X-Signature, X-Signature-Timestamp and X-Signature-Nonce")
+	}
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return errors.New("X-Signature-Nonce must be between 16 and 128 characters")
+	}
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("X-Signature-Timestamp must be a unix timestamp in seconds")
+	}
+	skew := signatureMaxSkew()
+	signedAt := time.Unix(unixTime, 0)
+	if math.Abs(time.Since(signedAt).Seconds()) > skew.Seconds() {
+		return errors.New("Signature timestamp is too old or too far in the future")
+	}
+	var body []byte
+	if r.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxSignedBodySize+1))
+		if err != nil {
+			return errors.New("Unable to read body")
+		}
+		if len(body) > maxSignedBodySize {
+			return errors.New("Body too large to sign")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	secret, err := hex.DecodeString(record.SigningSecret)
+	if err != nil {
+		return errors.New("Key has an invalid signing secret")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signingPayload(r, body, timestamp, nonce))
+	given, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(given, mac.Sum(nil)) {
+		return errors.New("Invalid signature")
+	}
+	// Only remembered once the signature is good, so junk requests can't use up another client's nonces
+	fresh := true
+	if store, ok := keyStore.(NonceStore); ok {
+		fresh, err = store.UseNonce(record.Id+":"+nonce, signedAt.Add(skew))
+		if err != nil {
+			log.Printf("Error saving signature nonce: %v", err)
+			return errNonceCheckFailed
+		}
+	} else {
+		fresh = usedNonces.use(record.Id+":"+nonce, signedAt.Add(skew))
+	}
+	if !fresh {
+		return errors.New("Signature nonce already used")
+	}
+	return nil
+}
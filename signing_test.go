@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSigningSecret = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+
+type signedRequest struct {
+	method    string
+	target    string
+	body      string
+	timestamp time.Time
+	nonce     string
+	// Body sent in place of the signed one, if set
+	sentBody string
+}
+
+func (s signedRequest) build() *http.Request {
+	sent := s.body
+	if s.sentBody != "" {
+		sent = s.sentBody
+	}
+	r := httptest.NewRequest(s.method, s.target, strings.NewReader(sent))
+	timestamp := strconv.FormatInt(s.timestamp.Unix(), 10)
+	secret, _ := hex.DecodeString(testSigningSecret)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signingPayload(r, []byte(s.body), timestamp, s.nonce))
+	r.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	r.Header.Set("X-Signature-Timestamp", timestamp)
+	r.Header.Set("X-Signature-Nonce", s.nonce)
+	return r
+}
+
+func TestVerifySignature(t *testing.T) {
+	keyStore = nil
+	usedNonces = &nonceCache{seen: map[string]time.Time{}}
+	record := &ApiKeyRecord{Id: "key", SigningSecret: testSigningSecret}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request signedRequest
+		wantErr string
+	}{
+		{"valid", signedRequest{method: "POST", target: "/api/tag/a", body: `{"description":"x"}`, timestamp: now, nonce: "nonce-valid-000001"}, ""},
+		{"replayed nonce", signedRequest{method: "POST", target: "/api/tag/a", body: `{"description":"x"}`, timestamp: now, nonce: "nonce-valid-000001"}, "Signature nonce already used"},
+		{"short nonce", signedRequest{method: "POST", target: "/api/tag/a", timestamp: now, nonce: "short"}, "X-Signature-Nonce must be between 16 and 128 characters"},
+		{"old timestamp", signedRequest{method: "POST", target: "/api/tag/a", timestamp: now.Add(-10 * time.Minute), nonce: "nonce-old-0000001"}, "Signature timestamp is too old or too far in the future"},
+		{"future timestamp", signedRequest{method: "POST", target: "/api/tag/a", timestamp: now.Add(10 * time.Minute), nonce: "nonce-future-00001"}, "Signature timestamp is too old or too far in the future"},
+		{"tampered body", signedRequest{method: "POST", target: "/api/tag/a", body: `{"description":"x"}`, sentBody: `{"description":"y"}`, timestamp: now, nonce: "nonce-tamper-00001"}, "Invalid signature"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifySignature(test.request.build(), record)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Fatalf("got error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureKeepsBody(t *testing.T) {
+	keyStore = nil
+	usedNonces = &nonceCache{seen: map[string]time.Time{}}
+	record := &ApiKeyRecord{Id: "key", SigningSecret: testSigningSecret}
+	r := signedRequest{method: "POST", target: "/api/tag/a", body: `{"description":"x"}`, timestamp: time.Now(), nonce: "nonce-body-000001"}.build()
+	err := verifySignature(r, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil || string(body) != `{"description":"x"}` {
+		t.Fatalf("got body %q, %v", body, err)
+	}
+}
+
+func TestVerifySignatureSharedNonces(t *testing.T) {
+	sharedDb, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sharedDb.Close()
+	sharedDb.SetMaxOpenConns(1)
+	store, err := newSqliteKeyStore(sharedDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyStore = store
+	defer func() { keyStore = nil }()
+	record := &ApiKeyRecord{Id: "key", SigningSecret: testSigningSecret}
+	request := signedRequest{method: "POST", target: "/api/tag/a", timestamp: time.Now(), nonce: "nonce-shared-00001"}
+	err = verifySignature(request.build(), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance has its own memory but the same store
+	usedNonces = &nonceCache{seen: map[string]time.Time{}}
+	err = verifySignature(request.build(), record)
+	if err == nil || err.Error() != "Signature nonce already used" {
+		t.Fatalf("got error %v, want the nonce to be rejected", err)
+	}
+	sharedDb.Exec("DROP TABLE signature_nonce")
+	request.nonce = "nonce-shared-00002"
+	err = verifySignature(request.build(), record)
+	if err != errNonceCheckFailed {
+		t.Fatalf("got error %v, want errNonceCheckFailed", err)
+	}
+}